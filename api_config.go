@@ -1,23 +1,40 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
 	"sync/atomic"
 
 	"encoding/json"
 
+	"github.com/OmarJarbou/Chirpy/internal/auth"
 	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/OmarJarbou/Chirpy/internal/mailer"
 )
 
 // will hold any stateful, in-memory data we'll need to keep track of.
 type apiConfig struct {
 	fileserverHits  atomic.Int32 // atomic.Int32 type is a really cool standard-library type that allows us to safely increment and read an integer value across multiple goroutines (HTTP requests).
+	DB              *sql.DB      // raw connection, only needed to open transactions (cfg.DBQueries.WithTx)
 	DBQueries       *database.Queries
-	ChirpySecretKey string
+	JWTKeys         *auth.KeySet // signs and verifies access tokens
+	RefreshTokenKey string       // keys the HMAC refresh, personal access and password reset tokens are stored as
+	EmailTokenKey   string       // signs the links of verification emails
 	PolkaKey        string
+	Platform        string // "dev" unlocks the endpoints that wipe data
+	PublicURL       string // where Chirpy is reachable from outside, for the links in emails
+	Mailer          mailer.Mailer
+	// RequireVerifiedEmail keeps users who haven't verified their email from posting chirps
+	RequireVerifiedEmail bool
+	PasswordPolicy       auth.PasswordPolicy // what new passwords must satisfy
+	Notifier             *notifier
+	ChirpStream          *chirpBroadcaster
+	WSHub                *wsHub
 }
 
+const PLATFORM_DEV = "dev"
+
 type resetSuccessResponseBody struct {
 	Message string `json:"message"`
 }
@@ -38,11 +55,19 @@ func (cfg *apiConfig) numberOfRequestsEncountered(response_writer http.ResponseW
 func (cfg *apiConfig) resetFileServerHits(response_writer http.ResponseWriter, req *http.Request) {
 	errResBody := errorResponseBody{}
 	var jsonResBody []byte
-	err := cfg.DBQueries.DeleteAllUsers(req.Context())
-	if err != nil {
-		errResBody.Error = "Error while deleting users from database: " + err.Error()
-		jsonResBody, err2 := json.Marshal(errResBody)
-		writeJSONResponse(response_writer, jsonResBody, err2, 500)
+
+	if cfg.Platform != PLATFORM_DEV {
+		errResBody.Error = "Reset is only allowed when PLATFORM is " + PLATFORM_DEV
+		jsonResBody, err := json.Marshal(errResBody)
+		writeJSONResponse(response_writer, jsonResBody, err, 403)
+		return
+	}
+
+	err2 := cfg.DBQueries.DeleteAllUsers(req.Context())
+	if err2 != nil {
+		errResBody.Error = "Error while deleting users from database: " + err2.Error()
+		jsonResBody, err3 := json.Marshal(errResBody)
+		writeJSONResponse(response_writer, jsonResBody, err3, 500)
 		return
 	}
 
@@ -50,6 +75,6 @@ func (cfg *apiConfig) resetFileServerHits(response_writer http.ResponseWriter, r
 	resetSuccessResBody := resetSuccessResponseBody{
 		Message: "File server hits has been reset successfully",
 	}
-	jsonResBody, err3 := json.Marshal(resetSuccessResBody)
-	writeJSONResponse(response_writer, jsonResBody, err3, 200)
+	jsonResBody, err4 := json.Marshal(resetSuccessResBody)
+	writeJSONResponse(response_writer, jsonResBody, err4, 200)
 }
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
-	"sort"
 	"time"
 
 	"github.com/OmarJarbou/Chirpy/internal/database"
@@ -11,8 +11,10 @@ import (
 )
 
 type createChirpRequestBody struct {
-	Body   string `json:"body"`
-	UserID string `json:"user_id"`
+	Body      string `json:"body"`
+	UserID    string `json:"user_id"`
+	InReplyTo string `json:"in_reply_to"`
+	QuoteOf   string `json:"quote_of"`
 }
 
 type Chirp struct {
@@ -21,6 +23,85 @@ type Chirp struct {
 	UpdatedAt time.Time `json:"updated_at"`
 	Body      string    `json:"body"`
 	UserID    string    `json:"user_id"`
+	InReplyTo string    `json:"in_reply_to,omitempty"`
+	RootID    string    `json:"root_id"`
+	Deleted   bool      `json:"deleted,omitempty"`
+
+	RechirpOf      string           `json:"rechirp_of,omitempty"`
+	RechirpedChirp *referencedChirp `json:"rechirped_chirp,omitempty"`
+	QuoteOf        string           `json:"quote_of,omitempty"`
+	QuotedChirp    *referencedChirp `json:"quoted_chirp,omitempty"`
+
+	LikeCount       int64 `json:"like_count"`
+	ViewerLiked     bool  `json:"viewer_liked"`
+	RechirpCount    int64 `json:"rechirp_count"`
+	ViewerRechirped bool  `json:"viewer_rechirped"`
+}
+
+// newChirpResponse maps a chirps row to its JSON shape.
+// A deleted chirp that still anchors a thread is returned as a tombstone: no body and no author.
+func newChirpResponse(chirp database.Chirp) Chirp {
+	response := Chirp{
+		ID:        chirp.ID.String(),
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+		Body:      chirp.Body,
+		UserID:    chirp.UserID.String(),
+		RootID:    chirp.RootID.String(),
+	}
+	if chirp.InReplyTo.Valid {
+		response.InReplyTo = chirp.InReplyTo.UUID.String()
+	}
+	if chirp.RechirpOf.Valid {
+		response.RechirpOf = chirp.RechirpOf.UUID.String()
+	}
+	if chirp.QuoteOf.Valid {
+		response.QuoteOf = chirp.QuoteOf.UUID.String()
+	}
+	if chirp.DeletedAt.Valid {
+		response.Body = ""
+		response.UserID = ""
+		response.Deleted = true
+	}
+	return response
+}
+
+// decorateChirps adds everything to a page of chirps that doesn't live on the chirps row itself:
+// the chirps they rechirp or quote, and like/rechirp counts for all of them.
+func (cfg *apiConfig) decorateChirps(ctx context.Context, chirps []Chirp, viewer_id uuid.NullUUID) error {
+	if err := cfg.addReferencedChirps(ctx, chirps); err != nil {
+		return err
+	}
+
+	referenced := []Chirp{}
+	for _, chirp := range chirps {
+		for _, reference := range []*referencedChirp{chirp.RechirpedChirp, chirp.QuotedChirp} {
+			if reference != nil && reference.Chirp != nil {
+				referenced = append(referenced, *reference.Chirp)
+			}
+		}
+	}
+
+	all := append(append([]Chirp{}, chirps...), referenced...)
+	if err := cfg.addLikeStats(ctx, all, viewer_id); err != nil {
+		return err
+	}
+	if err := cfg.addRechirpStats(ctx, all, viewer_id); err != nil {
+		return err
+	}
+
+	copy(chirps, all[:len(chirps)])
+	next_referenced := len(chirps)
+	for _, chirp := range chirps {
+		for _, reference := range []*referencedChirp{chirp.RechirpedChirp, chirp.QuotedChirp} {
+			if reference != nil && reference.Chirp != nil {
+				*reference.Chirp = all[next_referenced]
+				next_referenced++
+			}
+		}
+	}
+
+	return nil
 }
 
 func (cfg *apiConfig) handleCreateChirp(response_writer http.ResponseWriter, req *http.Request) {
@@ -28,86 +109,204 @@ func (cfg *apiConfig) handleCreateChirp(response_writer http.ResponseWriter, req
 	var jsonResBody []byte
 	id := req.Context().Value("user_id").(uuid.UUID)
 
+	in_reply_to := uuid.NullUUID{}
+	parent_author := uuid.UUID{}
+	if in_reply_to_string := req.Context().Value("in_reply_to").(string); in_reply_to_string != "" {
+		parent_id, err := uuid.Parse(in_reply_to_string)
+		if err != nil {
+			errorResBody.Error = "Error while parsing in_reply_to string to uuid: " + err.Error()
+			jsonResBody, err2 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err2, 400)
+			return
+		}
+
+		// replying to a rechirp replies to the chirp it reposts
+		parent, ok := cfg.getOriginalChirp(req.Context(), parent_id)
+		if !ok {
+			errorResBody.Error = "The chirp you are replying to doesn't exist"
+			jsonResBody, err3 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err3, 404)
+			return
+		}
+		in_reply_to = uuid.NullUUID{UUID: parent.ID, Valid: true}
+		parent_author = parent.UserID
+	}
+
+	quote_of := uuid.NullUUID{}
+	if quote_of_string := req.Context().Value("quote_of").(string); quote_of_string != "" {
+		quoted_id, err4 := uuid.Parse(quote_of_string)
+		if err4 != nil {
+			errorResBody.Error = "Error while parsing quote_of string to uuid: " + err4.Error()
+			jsonResBody, err5 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err5, 400)
+			return
+		}
+
+		quoted, ok := cfg.getOriginalChirp(req.Context(), quoted_id)
+		if !ok {
+			errorResBody.Error = "The chirp you are quoting doesn't exist"
+			jsonResBody, err6 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err6, 404)
+			return
+		}
+		quote_of = uuid.NullUUID{UUID: quoted.ID, Valid: true}
+	}
+
 	createChirpParams := database.CreateChirpParams{
-		Body:   req.Context().Value("filtered_chirp").(string),
-		UserID: id,
+		Body:      req.Context().Value("filtered_chirp").(string),
+		UserID:    id,
+		InReplyTo: in_reply_to,
+		QuoteOf:   quote_of,
 	}
 
-	chirp, err3 := cfg.DBQueries.CreateChirp(req.Context(), createChirpParams)
-	if err3 != nil {
-		errorResBody.Error = "Error while creating chirp: " + err3.Error()
-		jsonResBody, err4 := json.Marshal(errorResBody)
-		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+	tx, err7 := cfg.DB.BeginTx(req.Context(), nil)
+	if err7 != nil {
+		errorResBody.Error = "Error while starting transaction: " + err7.Error()
+		jsonResBody, err8 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err8, 500)
 		return
 	}
+	defer tx.Rollback()
+	queries := cfg.DBQueries.WithTx(tx)
 
-	successResBody := Chirp{
-		ID:        chirp.ID.String(),
-		CreatedAt: chirp.CreatedAt,
-		UpdatedAt: chirp.UpdatedAt,
-		Body:      chirp.Body,
-		UserID:    chirp.UserID.String(),
+	chirp, err9 := queries.CreateChirp(req.Context(), createChirpParams)
+	if err9 != nil {
+		errorResBody.Error = "Error while creating chirp: " + err9.Error()
+		jsonResBody, err10 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err10, 500)
+		return
 	}
-	jsonResBody, err5 := json.Marshal(successResBody)
-	writeJSONResponse(response_writer, jsonResBody, err5, 201)
+
+	if err11 := saveChirpTags(req.Context(), queries, chirp); err11 != nil {
+		errorResBody.Error = "Error while saving chirp tags: " + err11.Error()
+		jsonResBody, err12 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err12, 500)
+		return
+	}
+
+	mentioned, err13 := saveChirpMentions(req.Context(), queries, chirp)
+	if err13 != nil {
+		errorResBody.Error = "Error while saving chirp mentions: " + err13.Error()
+		jsonResBody, err14 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err14, 500)
+		return
+	}
+
+	if err15 := tx.Commit(); err15 != nil {
+		errorResBody.Error = "Error while committing chirp creation: " + err15.Error()
+		jsonResBody, err16 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err16, 500)
+		return
+	}
+
+	// notifications go out once the chirp is committed, so they never point at a chirp that was rolled back
+	chirp_id := uuid.NullUUID{UUID: chirp.ID, Valid: true}
+	actor_id := uuid.NullUUID{UUID: id, Valid: true}
+	if in_reply_to.Valid {
+		cfg.Notifier.Notify(pendingNotification{
+			UserID:  parent_author,
+			Kind:    NOTIFICATION_REPLY,
+			ActorID: actor_id,
+			ChirpID: chirp_id,
+		})
+	}
+	for _, mentioned_id := range mentioned {
+		// a reply already told the parent's author about it
+		if in_reply_to.Valid && mentioned_id == parent_author {
+			continue
+		}
+		cfg.Notifier.Notify(pendingNotification{
+			UserID:  mentioned_id,
+			Kind:    NOTIFICATION_MENTION,
+			ActorID: actor_id,
+			ChirpID: chirp_id,
+		})
+	}
+
+	successResBody := []Chirp{newChirpResponse(chirp)}
+	if err17 := cfg.decorateChirps(req.Context(), successResBody, viewerID(req)); err17 != nil {
+		errorResBody.Error = "Error while fetching chirp details from database: " + err17.Error()
+		jsonResBody, err18 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err18, 500)
+		return
+	}
+
+	cfg.publishChirpCreated(successResBody[0])
+
+	jsonResBody, err19 := json.Marshal(successResBody[0])
+	writeJSONResponse(response_writer, jsonResBody, err19, 201)
 }
 
 func (cfg *apiConfig) handleGetAllChirps(response_writer http.ResponseWriter, req *http.Request) {
 	errorResBody := errorResponseBody{}
 	var jsonResBody []byte
 
-	var chirps []database.Chirp
-	var err error
+	page_params, err := parsePageParams(req.URL.Query(), "asc")
+	if err != nil {
+		errorResBody.Error = err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	author_uuid := uuid.NullUUID{}
 	author_id := req.URL.Query().Get("author_id")
-	sortq := req.URL.Query().Get("sort")
-	if author_id == "" {
-		chirps, err = cfg.DBQueries.GetAllChirps(req.Context())
-		if err != nil {
-			errorResBody.Error = "Error while fetching chirps from database: " + err.Error()
-			jsonResBody, err2 := json.Marshal(errorResBody)
-			writeJSONResponse(response_writer, jsonResBody, err2, 500)
-			return
-		}
-	} else {
-		author_uuid, err3 := uuid.Parse(author_id)
+	if author_id != "" {
+		parsed_author_id, err3 := uuid.Parse(author_id)
 		if err3 != nil {
 			errorResBody.Error = "Invalid UUID: " + err3.Error()
 			jsonResBody, err4 := json.Marshal(errorResBody)
 			writeJSONResponse(response_writer, jsonResBody, err4, 401)
 			return
 		}
-		chirps, err = cfg.DBQueries.GetAllChirpsForAUser(req.Context(), author_uuid)
-		if err != nil {
-			errorResBody.Error = "Error while fetching chirps for a user from database: " + err.Error()
-			jsonResBody, err5 := json.Marshal(errorResBody)
-			writeJSONResponse(response_writer, jsonResBody, err5, 500)
-			return
-		}
+		author_uuid = uuid.NullUUID{UUID: parsed_author_id, Valid: true}
 	}
-	if sortq == "asc" {
-		sort.SliceStable(chirps, func(i, j int) bool {
-			return chirps[i].CreatedAt.Before(chirps[j].CreatedAt)
-		})
-	} else if sortq == "desc" {
-		sort.SliceStable(chirps, func(i, j int) bool {
-			return chirps[i].CreatedAt.After(chirps[j].CreatedAt)
+
+	fetch := func(ascending bool, c *cursor, limit int32) ([]database.Chirp, error) {
+		cursor_created_at, cursor_id := cursorPosition(c)
+		if ascending {
+			return cfg.DBQueries.ListChirpsAfter(req.Context(), database.ListChirpsAfterParams{
+				AuthorID:        author_uuid,
+				CursorCreatedAt: cursor_created_at,
+				CursorID:        cursor_id,
+				PageLimit:       limit,
+			})
+		}
+		return cfg.DBQueries.ListChirpsBefore(req.Context(), database.ListChirpsBeforeParams{
+			AuthorID:        author_uuid,
+			CursorCreatedAt: cursor_created_at,
+			CursorID:        cursor_id,
+			PageLimit:       limit,
 		})
 	}
+	position := func(chirp database.Chirp) (time.Time, uuid.UUID) {
+		return chirp.CreatedAt, chirp.ID
+	}
+
+	chirps, next_cursor, prev_cursor, err5 := paginate(page_params, fetch, position)
+	if err5 != nil {
+		errorResBody.Error = "Error while fetching chirps from database: " + err5.Error()
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 500)
+		return
+	}
 
 	successResBody := []Chirp{}
 
 	for _, chirp := range chirps {
-		successResBody = append(successResBody, Chirp{
-			ID:        chirp.ID.String(),
-			CreatedAt: chirp.CreatedAt,
-			UpdatedAt: chirp.UpdatedAt,
-			Body:      chirp.Body,
-			UserID:    chirp.UserID.String(),
-		})
+		successResBody = append(successResBody, newChirpResponse(chirp))
+	}
+
+	if err7 := cfg.decorateChirps(req.Context(), successResBody, viewerID(req)); err7 != nil {
+		errorResBody.Error = "Error while fetching chirp details from database: " + err7.Error()
+		jsonResBody, err8 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err8, 500)
+		return
 	}
 
-	jsonResBody, err3 := json.Marshal(successResBody)
-	writeJSONResponse(response_writer, jsonResBody, err3, 200)
+	setPaginationLinks(response_writer, req, next_cursor, prev_cursor)
+	jsonResBody, err9 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err9, 200)
 }
 
 func (cfg *apiConfig) handleGetChirpByID(response_writer http.ResponseWriter, req *http.Request) {
@@ -130,13 +329,169 @@ func (cfg *apiConfig) handleGetChirpByID(response_writer http.ResponseWriter, re
 		return
 	}
 
-	successResBody := Chirp{
-		ID:        chirp.ID.String(),
-		CreatedAt: chirp.CreatedAt,
-		UpdatedAt: chirp.UpdatedAt,
+	if chirp.DeletedAt.Valid {
+		errorResBody.Error = "Chirp with id '" + chirp_id + "' has been deleted"
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 404)
+		return
+	}
+
+	successResBody := []Chirp{newChirpResponse(chirp)}
+	if err6 := cfg.decorateChirps(req.Context(), successResBody, viewerID(req)); err6 != nil {
+		errorResBody.Error = "Error while fetching chirp details from database: " + err6.Error()
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 500)
+		return
+	}
+
+	jsonResBody, err8 := json.Marshal(successResBody[0])
+	writeJSONResponse(response_writer, jsonResBody, err8, 200)
+}
+
+type chirpRevision struct {
+	ID         string    `json:"id"`
+	ChirpID    string    `json:"chirp_id"`
+	Body       string    `json:"body"`
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+func (cfg *apiConfig) handleUpdateChirp(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	chirp_uuid, err := uuid.Parse(req.PathValue("chirpID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing chirp id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	tx, err3 := cfg.DB.BeginTx(req.Context(), nil)
+	if err3 != nil {
+		errorResBody.Error = "Error while starting transaction: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+	defer tx.Rollback()
+	queries := cfg.DBQueries.WithTx(tx)
+
+	chirp, err5 := queries.GetChirpByIdForUpdate(req.Context(), chirp_uuid)
+	if err5 != nil || chirp.DeletedAt.Valid {
+		errorResBody.Error = "No chirp with this id"
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 404)
+		return
+	}
+
+	if chirp.UserID != user_id {
+		errorResBody.Error = "You don't have access to do anything on this chirp: "
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 403)
+		return
+	}
+
+	if chirp.RechirpOf.Valid {
+		errorResBody.Error = "Rechirps can't be edited"
+		jsonResBody, err8 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err8, 400)
+		return
+	}
+
+	_, err9 := queries.CreateChirpRevision(req.Context(), database.CreateChirpRevisionParams{
+		ChirpID:   chirp.ID,
 		Body:      chirp.Body,
-		UserID:    chirp.UserID.String(),
+		CreatedAt: chirp.UpdatedAt,
+	})
+	if err9 != nil {
+		errorResBody.Error = "Error while saving chirp revision: " + err9.Error()
+		jsonResBody, err10 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err10, 500)
+		return
+	}
+
+	updated_chirp, err11 := queries.UpdateChirpBody(req.Context(), database.UpdateChirpBodyParams{
+		Body: req.Context().Value("filtered_chirp").(string),
+		ID:   chirp.ID,
+	})
+	if err11 != nil {
+		errorResBody.Error = "Error while updating chirp: " + err11.Error()
+		jsonResBody, err12 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err12, 500)
+		return
+	}
+
+	if err13 := saveChirpTags(req.Context(), queries, updated_chirp); err13 != nil {
+		errorResBody.Error = "Error while saving chirp tags: " + err13.Error()
+		jsonResBody, err14 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err14, 500)
+		return
 	}
-	jsonResBody, err5 := json.Marshal(successResBody)
-	writeJSONResponse(response_writer, jsonResBody, err5, 200)
+
+	if err15 := tx.Commit(); err15 != nil {
+		errorResBody.Error = "Error while committing chirp update: " + err15.Error()
+		jsonResBody, err16 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err16, 500)
+		return
+	}
+
+	successResBody := []Chirp{newChirpResponse(updated_chirp)}
+	if err17 := cfg.decorateChirps(req.Context(), successResBody, viewerID(req)); err17 != nil {
+		errorResBody.Error = "Error while fetching chirp details from database: " + err17.Error()
+		jsonResBody, err18 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err18, 500)
+		return
+	}
+
+	jsonResBody, err19 := json.Marshal(successResBody[0])
+	writeJSONResponse(response_writer, jsonResBody, err19, 200)
+}
+
+func (cfg *apiConfig) handleGetChirpRevisions(response_writer http.ResponseWriter, req *http.Request) {
+	chirp_id := req.PathValue("chirpID")
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	parsed_chirp_id, err := uuid.Parse(chirp_id)
+	if err != nil {
+		errorResBody.Error = "Invalid UUID: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	chirp, err3 := cfg.DBQueries.GetChirpById(req.Context(), parsed_chirp_id)
+	if err3 != nil || chirp.DeletedAt.Valid {
+		errorResBody.Error = "No chirp with id '" + chirp_id + "'"
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 404)
+		return
+	}
+
+	revisions, err5 := cfg.DBQueries.GetChirpRevisions(req.Context(), parsed_chirp_id)
+	if err5 != nil {
+		errorResBody.Error = "Error while fetching chirp revisions from database: " + err5.Error()
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 500)
+		return
+	}
+
+	successResBody := []chirpRevision{}
+
+	for _, revision := range revisions {
+		successResBody = append(successResBody, chirpRevision{
+			ID:         revision.ID.String(),
+			ChirpID:    revision.ChirpID.String(),
+			Body:       revision.Body,
+			CreatedAt:  revision.CreatedAt,
+			ReplacedAt: revision.ReplacedAt,
+		})
+	}
+
+	jsonResBody, err7 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err7, 200)
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/OmarJarbou/Chirpy/internal/auth"
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/OmarJarbou/Chirpy/internal/mailer"
+	"github.com/google/uuid"
+)
+
+const EMAIL_VERIFICATION_EXP_TIME = 24 * time.Hour
+
+type verifyEmailSuccessResponseBody struct {
+	Message string `json:"message"`
+}
+
+// sendEmailVerification mails the user a link to GET /api/users/verify.
+// Every link gets a new nonce, so only the most recent link sent to a user works.
+func (cfg *apiConfig) sendEmailVerification(ctx context.Context, user database.User) error {
+	nonce := uuid.New()
+	err := cfg.DBQueries.SetEmailVerificationNonce(ctx, database.SetEmailVerificationNonceParams{
+		ID:                     user.ID,
+		EmailVerificationNonce: uuid.NullUUID{UUID: nonce, Valid: true},
+	})
+	if err != nil {
+		return errors.New("Error while saving email verification nonce: " + err.Error())
+	}
+
+	token, err2 := auth.MakeEmailVerificationToken(auth.EmailVerification{
+		UserID: user.ID,
+		Email:  user.Email,
+		Nonce:  nonce,
+	}, cfg.EmailTokenKey, EMAIL_VERIFICATION_EXP_TIME)
+	if err2 != nil {
+		return err2
+	}
+
+	link := cfg.PublicURL + "/api/users/verify?token=" + url.QueryEscape(token)
+	return cfg.Mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email address",
+		Body:    "Hi @" + user.Handle + ",\n\nOpen this link within 24 hours to verify your email address:\n" + link + "\n\nIf you didn't sign up for Chirpy, you can ignore this email.\n",
+	})
+}
+
+func (cfg *apiConfig) handleVerifyEmail(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	verification, err := auth.ValidateEmailVerificationToken(req.URL.Query().Get("token"), cfg.EmailTokenKey)
+	if err != nil {
+		errorResBody.Error = "Invalid verification link: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	rows, err3 := cfg.DBQueries.VerifyUserEmail(req.Context(), database.VerifyUserEmailParams{
+		ID:    verification.UserID,
+		Email: verification.Email,
+		Nonce: uuid.NullUUID{UUID: verification.Nonce, Valid: true},
+	})
+	if err3 != nil {
+		errorResBody.Error = "Error while verifying email: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	// the nonce is cleared once used, and replaced when a newer link is sent or the address changes
+	if rows == 0 {
+		errorResBody.Error = "This verification link was already used or replaced by a newer one"
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 400)
+		return
+	}
+
+	successResBody := verifyEmailSuccessResponseBody{
+		Message: "Email " + verification.Email + " is verified",
+	}
+	jsonResBody, err6 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err6, 200)
+}
+
+func (cfg *apiConfig) handleResendEmailVerification(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	user, err := cfg.DBQueries.GetUserById(req.Context(), user_id)
+	if err != nil {
+		errorResBody.Error = "Error while fetching user: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 500)
+		return
+	}
+
+	if user.EmailVerified {
+		errorResBody.Error = "Email is already verified"
+		jsonResBody, err3 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err3, 409)
+		return
+	}
+
+	if err4 := cfg.sendEmailVerification(req.Context(), user); err4 != nil {
+		errorResBody.Error = err4.Error()
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 500)
+		return
+	}
+
+	response_writer.WriteHeader(204)
+}
+
+// middlewareRequireVerifiedEmail goes after middlewareAuthorize, and turns away users who haven't verified their email
+// when REQUIRE_VERIFIED_EMAIL is on. It reads the database rather than the token, so verifying takes effect right away.
+func (cfg *apiConfig) middlewareRequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response_writer http.ResponseWriter, req *http.Request) {
+		errorResBody := errorResponseBody{}
+
+		if !cfg.RequireVerifiedEmail {
+			next.ServeHTTP(response_writer, req)
+			return
+		}
+
+		user_id := req.Context().Value("user_id").(uuid.UUID)
+		user, err := cfg.DBQueries.GetUserById(req.Context(), user_id)
+		if errors.Is(err, sql.ErrNoRows) {
+			errorResBody.Error = "User doesn't exist anymore"
+			jsonResBody, err2 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err2, 401)
+			return
+		}
+		if err != nil {
+			errorResBody.Error = "Error while fetching user: " + err.Error()
+			jsonResBody, err3 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err3, 500)
+			return
+		}
+
+		if !user.EmailVerified {
+			errorResBody.Error = "Verify your email address first"
+			jsonResBody, err4 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err4, 403)
+			return
+		}
+
+		next.ServeHTTP(response_writer, req)
+	})
+}
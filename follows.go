@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+type followUser struct {
+	UserID      string    `json:"user_id"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	FollowedAt  time.Time `json:"followed_at"`
+
+	id uuid.UUID
+}
+
+type followCountsResponseBody struct {
+	Followers int64 `json:"followers"`
+	Following int64 `json:"following"`
+}
+
+func (cfg *apiConfig) handleFollowUser(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	follower_id := req.Context().Value("user_id").(uuid.UUID)
+
+	followee_id, err := uuid.Parse(req.PathValue("userID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing user id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	if followee_id == follower_id {
+		errorResBody.Error = "You can't follow yourself"
+		jsonResBody, err3 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err3, 400)
+		return
+	}
+
+	_, err4 := cfg.DBQueries.GetUserById(req.Context(), followee_id)
+	if err4 != nil {
+		errorResBody.Error = "No user with this id: " + err4.Error()
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 404)
+		return
+	}
+
+	rows, err6 := cfg.DBQueries.FollowUser(req.Context(), database.FollowUserParams{
+		FollowerID: follower_id,
+		FolloweeID: followee_id,
+	})
+	if err6 != nil {
+		errorResBody.Error = "Error while following user: " + err6.Error()
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 500)
+		return
+	}
+
+	if rows > 0 {
+		cfg.Notifier.Notify(pendingNotification{
+			UserID:  followee_id,
+			Kind:    NOTIFICATION_FOLLOW,
+			ActorID: uuid.NullUUID{UUID: follower_id, Valid: true},
+		})
+	}
+
+	response_writer.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handleUnfollowUser(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	follower_id := req.Context().Value("user_id").(uuid.UUID)
+
+	followee_id, err := uuid.Parse(req.PathValue("userID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing user id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	rows, err3 := cfg.DBQueries.UnfollowUser(req.Context(), database.UnfollowUserParams{
+		FollowerID: follower_id,
+		FolloweeID: followee_id,
+	})
+	if err3 != nil {
+		errorResBody.Error = "Error while unfollowing user: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	if rows == 0 {
+		errorResBody.Error = "You are not following this user"
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 404)
+		return
+	}
+
+	response_writer.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handleGetFollowers(response_writer http.ResponseWriter, req *http.Request) {
+	cfg.writeFollowList(response_writer, req, func(user_id uuid.UUID, ascending bool, c *cursor, limit int32) ([]followUser, error) {
+		cursor_created_at, cursor_id := cursorPosition(c)
+		users := []followUser{}
+		if ascending {
+			rows, err := cfg.DBQueries.ListFollowersAfter(req.Context(), database.ListFollowersAfterParams{
+				UserID:          user_id,
+				CursorCreatedAt: cursor_created_at,
+				CursorID:        cursor_id,
+				PageLimit:       limit,
+			})
+			for _, row := range rows {
+				users = append(users, newFollowUser(row.ID, row.IsChirpyRed, row.FollowedAt))
+			}
+			return users, err
+		}
+
+		rows, err := cfg.DBQueries.ListFollowersBefore(req.Context(), database.ListFollowersBeforeParams{
+			UserID:          user_id,
+			CursorCreatedAt: cursor_created_at,
+			CursorID:        cursor_id,
+			PageLimit:       limit,
+		})
+		for _, row := range rows {
+			users = append(users, newFollowUser(row.ID, row.IsChirpyRed, row.FollowedAt))
+		}
+		return users, err
+	})
+}
+
+func (cfg *apiConfig) handleGetFollowing(response_writer http.ResponseWriter, req *http.Request) {
+	cfg.writeFollowList(response_writer, req, func(user_id uuid.UUID, ascending bool, c *cursor, limit int32) ([]followUser, error) {
+		cursor_created_at, cursor_id := cursorPosition(c)
+		users := []followUser{}
+		if ascending {
+			rows, err := cfg.DBQueries.ListFollowingAfter(req.Context(), database.ListFollowingAfterParams{
+				UserID:          user_id,
+				CursorCreatedAt: cursor_created_at,
+				CursorID:        cursor_id,
+				PageLimit:       limit,
+			})
+			for _, row := range rows {
+				users = append(users, newFollowUser(row.ID, row.IsChirpyRed, row.FollowedAt))
+			}
+			return users, err
+		}
+
+		rows, err := cfg.DBQueries.ListFollowingBefore(req.Context(), database.ListFollowingBeforeParams{
+			UserID:          user_id,
+			CursorCreatedAt: cursor_created_at,
+			CursorID:        cursor_id,
+			PageLimit:       limit,
+		})
+		for _, row := range rows {
+			users = append(users, newFollowUser(row.ID, row.IsChirpyRed, row.FollowedAt))
+		}
+		return users, err
+	})
+}
+
+func newFollowUser(id uuid.UUID, is_chirpy_red bool, followed_at time.Time) followUser {
+	return followUser{
+		UserID:      id.String(),
+		IsChirpyRed: is_chirpy_red,
+		FollowedAt:  followed_at,
+		id:          id,
+	}
+}
+
+// writeFollowList serves one page of a user's followers or followees, newest follow first by default.
+// list fetches a page of them from the database, the same way as the fetch function of paginate.
+func (cfg *apiConfig) writeFollowList(response_writer http.ResponseWriter, req *http.Request, list func(user_id uuid.UUID, ascending bool, c *cursor, limit int32) ([]followUser, error)) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	user_id, err := uuid.Parse(req.PathValue("userID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing user id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	page_params, err3 := parsePageParams(req.URL.Query(), "desc")
+	if err3 != nil {
+		errorResBody.Error = err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 400)
+		return
+	}
+
+	fetch_page := func(ascending bool, c *cursor, limit int32) ([]followUser, error) {
+		return list(user_id, ascending, c, limit)
+	}
+	position := func(user followUser) (time.Time, uuid.UUID) {
+		return user.FollowedAt, user.id
+	}
+
+	users, next_cursor, prev_cursor, err5 := paginate(page_params, fetch_page, position)
+	if err5 != nil {
+		errorResBody.Error = "Error while fetching follows from database: " + err5.Error()
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 500)
+		return
+	}
+
+	setPaginationLinks(response_writer, req, next_cursor, prev_cursor)
+	jsonResBody, err7 := json.Marshal(users)
+	writeJSONResponse(response_writer, jsonResBody, err7, 200)
+}
+
+func (cfg *apiConfig) handleGetFollowCounts(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	user_id, err := uuid.Parse(req.PathValue("userID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing user id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	followers, err3 := cfg.DBQueries.CountFollowers(req.Context(), user_id)
+	if err3 != nil {
+		errorResBody.Error = "Error while counting followers: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	following, err5 := cfg.DBQueries.CountFollowing(req.Context(), user_id)
+	if err5 != nil {
+		errorResBody.Error = "Error while counting followed users: " + err5.Error()
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 500)
+		return
+	}
+
+	successResBody := followCountsResponseBody{
+		Followers: followers,
+		Following: following,
+	}
+	jsonResBody, err7 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err7, 200)
+}
+
+func (cfg *apiConfig) handleGetTimeline(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	page_params, err := parsePageParams(req.URL.Query(), "desc")
+	if err != nil {
+		errorResBody.Error = err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	fetch := func(ascending bool, c *cursor, limit int32) ([]database.Chirp, error) {
+		cursor_created_at, cursor_id := cursorPosition(c)
+		if ascending {
+			return cfg.DBQueries.ListTimelineAfter(req.Context(), database.ListTimelineAfterParams{
+				UserID:          user_id,
+				CursorCreatedAt: cursor_created_at,
+				CursorID:        cursor_id,
+				PageLimit:       limit,
+			})
+		}
+		return cfg.DBQueries.ListTimelineBefore(req.Context(), database.ListTimelineBeforeParams{
+			UserID:          user_id,
+			CursorCreatedAt: cursor_created_at,
+			CursorID:        cursor_id,
+			PageLimit:       limit,
+		})
+	}
+	position := func(chirp database.Chirp) (time.Time, uuid.UUID) {
+		return chirp.CreatedAt, chirp.ID
+	}
+
+	chirps, next_cursor, prev_cursor, err3 := paginate(page_params, fetch, position)
+	if err3 != nil {
+		errorResBody.Error = "Error while fetching timeline from database: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	successResBody := []Chirp{}
+
+	for _, chirp := range chirps {
+		successResBody = append(successResBody, newChirpResponse(chirp))
+	}
+
+	if err5 := cfg.decorateChirps(req.Context(), successResBody, viewerID(req)); err5 != nil {
+		errorResBody.Error = "Error while fetching chirp details from database: " + err5.Error()
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 500)
+		return
+	}
+
+	setPaginationLinks(response_writer, req, next_cursor, prev_cursor)
+	jsonResBody, err7 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err7, 200)
+}
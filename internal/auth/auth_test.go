@@ -1,9 +1,17 @@
 package auth
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
@@ -37,24 +45,156 @@ func TestCheckPasswordHash(t *testing.T) {
 	}
 }
 
+func TestArgon2idPasswordHash(t *testing.T) {
+	long := strings.Repeat("a", 100)
+	hashed, err := HashPassword(long)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.HasPrefix(hashed, "$argon2id$v=19$m=65536,t=3,p=4$") {
+		t.Errorf("hash isn't argon2id with the default parameters: %s", hashed)
+	}
+	if err := CheckPasswordHash(long, hashed); err != nil {
+		t.Errorf("%v", err)
+	}
+	// bcrypt would stop at 72 bytes and let this one in
+	if err := CheckPasswordHash(long[:72]+"b", hashed); err == nil {
+		t.Errorf("password differing after 72 bytes matched")
+	}
+	if PasswordNeedsRehash(hashed) {
+		t.Errorf("hash with the current parameters needs rehash")
+	}
+}
+
+func TestPasswordHashUpgrade(t *testing.T) {
+	bcrypt_hash := "$2a$10$bRlYjIKxKW65XrkLqLC9I.mpOB/4Wo0Cr6JqwyXDULIJR7X8GlqbK"
+	if !PasswordNeedsRehash(bcrypt_hash) {
+		t.Errorf("bcrypt hash doesn't need rehash")
+	}
+
+	old_params := passwordHashParams
+	defer func() { passwordHashParams = old_params }()
+	if err := SetPasswordHashParams(Argon2idParams{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	hashed, err := HashPassword("Omar@123456")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	passwordHashParams = old_params
+	if err := CheckPasswordHash("Omar@123456", hashed); err != nil {
+		t.Errorf("hash made with older parameters doesn't check out: %v", err)
+	}
+	if !PasswordNeedsRehash(hashed) {
+		t.Errorf("hash made with older parameters doesn't need rehash")
+	}
+
+	if err := SetPasswordHashParams(Argon2idParams{Memory: 64 * 1024, Iterations: 0, Parallelism: 1, SaltLength: 16, KeyLength: 32}); err == nil {
+		t.Errorf("parameters without iterations were accepted")
+	}
+}
+
+func TestRejectUnknownPasswordHash(t *testing.T) {
+	for _, hash := range []string{
+		LEGACY_UNSET_PASSWORD_HASH,
+		"",
+		"plaintext-password",
+		"$argon2id$v=19$m=65536,t=3,p=4$not-base64!$x",
+		"$argon2i$v=19$m=65536,t=3,p=4$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA",
+	} {
+		for _, password := range []string{"", "unset", "plaintext-password"} {
+			if err := CheckPasswordHash(password, hash); err == nil {
+				t.Errorf("password %q matched hash %q", password, hash)
+			}
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:       10,
+		RequiredClasses: []string{PASSWORD_CLASS_LOWERCASE, PASSWORD_CLASS_UPPERCASE, PASSWORD_CLASS_DIGIT, PASSWORD_CLASS_SYMBOL},
+		ForbidEmail:     true,
+		ForbidBreached:  true,
+	}
+	tests := []struct {
+		password string
+		email    string
+		want     []string
+	}{
+		{"Correct-Horse-7", "omar@example.com", []string{}},
+		{"", "omar@example.com", []string{PASSWORD_RULE_MIN_LENGTH, PASSWORD_RULE_CHARACTER_CLASS, PASSWORD_RULE_CHARACTER_CLASS, PASSWORD_RULE_CHARACTER_CLASS, PASSWORD_RULE_CHARACTER_CLASS}},
+		{"password", "omar@example.com", []string{PASSWORD_RULE_MIN_LENGTH, PASSWORD_RULE_CHARACTER_CLASS, PASSWORD_RULE_CHARACTER_CLASS, PASSWORD_RULE_CHARACTER_CLASS, PASSWORD_RULE_BREACHED}},
+		{"Omar-Is-Here-2024", "OMAR@example.com", []string{PASSWORD_RULE_CONTAINS_EMAIL}},
+		{"My-Login:omar@example.com1", "omar@example.com", []string{PASSWORD_RULE_CONTAINS_EMAIL}},
+		{"Jo-Is-Here-2024", "jo@example.com", []string{}},
+		{"P@ssw0rd", "omar@example.com", []string{PASSWORD_RULE_MIN_LENGTH, PASSWORD_RULE_BREACHED}},
+	}
+	for _, test := range tests {
+		violations := policy.Check(test.password, test.email)
+		got := []string{}
+		for _, violation := range violations {
+			got = append(got, violation.Rule)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("Check(%q, %q) = %v, want %v", test.password, test.email, got, test.want)
+		}
+	}
+
+	if violations := (PasswordPolicy{}).Check("", ""); len(violations) != 0 {
+		t.Errorf("empty policy refused a password: %v", violations)
+	}
+
+	classes, err := ParsePasswordClasses(" Uppercase, digit ,")
+	if err != nil || strings.Join(classes, ",") != "uppercase,digit" {
+		t.Errorf("ParsePasswordClasses = %v, %v", classes, err)
+	}
+	if _, err := ParsePasswordClasses("emoji"); err == nil {
+		t.Errorf("unknown character class was accepted")
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{5, 0},
+		{6, 30 * time.Second},
+		{7, time.Minute},
+		{9, 4 * time.Minute},
+		{11, 15 * time.Minute},
+		{1000, 15 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := LoginBackoff(test.failures, 5, 30*time.Second, 15*time.Minute); got != test.want {
+			t.Errorf("Expected a %v lock after %d failures, got %v", test.want, test.failures, got)
+		}
+	}
+}
+
 type makeJWTTestData struct {
 	UserID        uuid.UUID
-	TokenSecret   string
 	ExpiresIn     time.Duration
 	ErrorExpected bool
 }
 
 func TestJWTFlow(t *testing.T) {
+	key_set, err := GenerateKeySet()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
 	tests := []makeJWTTestData{
 		{
 			UserID:        uuid.MustParse("b3a29e2e-54e4-4b84-a991-07b5f63c2a6a"),
-			TokenSecret:   "super-secret-key-123!@#",
 			ExpiresIn:     15 * time.Minute,
 			ErrorExpected: false,
 		},
 		{
 			UserID:        uuid.MustParse("9f36d4c2-7d3b-4e12-8b65-3f8936e4babc"),
-			TokenSecret:   "another-secret-key-456$%^",
 			ExpiresIn:     -10 * time.Minute,
 			ErrorExpected: true,
 		},
@@ -63,7 +203,7 @@ func TestJWTFlow(t *testing.T) {
 	tokens := []string{}
 
 	for i, test := range tests {
-		token_string, err := MakeJWT(test.UserID, test.TokenSecret, test.ExpiresIn)
+		token_string, err := key_set.MakeJWT(test.UserID, "user", test.ExpiresIn)
 		if err != nil {
 			t.Errorf("%v", err)
 		}
@@ -72,7 +212,7 @@ func TestJWTFlow(t *testing.T) {
 	}
 
 	for i, token := range tokens {
-		user_id, err := ValidateJWT(token, tests[i].TokenSecret)
+		user_id, err := key_set.ValidateJWT(token)
 		if tests[i].ErrorExpected {
 			if err == nil {
 				t.Errorf("Expected an error for token %d, but got none", i)
@@ -89,3 +229,346 @@ func TestJWTFlow(t *testing.T) {
 	}
 
 }
+
+func TestValidateJWTWithExpiry(t *testing.T) {
+	user_id := uuid.MustParse("b3a29e2e-54e4-4b84-a991-07b5f63c2a6a")
+	key_set, err := GenerateKeySet()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	token_string, err := key_set.MakeJWT(user_id, "user", 15*time.Minute)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	validated_id, expires_at, err := key_set.ValidateJWTWithExpiry(token_string)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if validated_id != user_id {
+		t.Errorf("Expected user %s, got %s", user_id, validated_id)
+	}
+	// the exp claim only keeps whole seconds
+	if expires_at.Before(time.Now().Add(14*time.Minute)) || expires_at.After(time.Now().Add(16*time.Minute)) {
+		t.Errorf("Expected the token to expire in about 15 minutes, got %v", expires_at)
+	}
+
+	other_key_set, err := GenerateKeySet()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, _, err := other_key_set.ValidateJWTWithExpiry(token_string); err == nil {
+		t.Errorf("Expected an error for a token signed with another key, but got none")
+	}
+}
+
+func TestHashRefreshToken(t *testing.T) {
+	token, err := MakeRefreshToken()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	hashed := HashRefreshToken(token, "super-secret-key-123!@#")
+	if hashed == token {
+		t.Errorf("Expected the stored value to differ from the token")
+	}
+	if hashed != HashRefreshToken(token, "super-secret-key-123!@#") {
+		t.Errorf("Expected hashing the same token with the same key to give the same hash")
+	}
+	if hashed == HashRefreshToken(token, "another-secret-key-456$%^") {
+		t.Errorf("Expected hashing with another key to give another hash")
+	}
+}
+
+func TestPersonalAccessToken(t *testing.T) {
+	token, err := MakePersonalAccessToken()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if !IsPersonalAccessToken(token) {
+		t.Errorf("Expected %s to be recognized as a personal access token", token)
+	}
+	refresh_token, _ := MakeRefreshToken()
+	if IsPersonalAccessToken(refresh_token) {
+		t.Errorf("Expected a refresh token not to be recognized as a personal access token")
+	}
+
+	other, _ := MakePersonalAccessToken()
+	if token == other {
+		t.Errorf("Expected two personal access tokens to differ")
+	}
+	if HashPersonalAccessToken(token, "super-secret-key-123!@#") == HashPersonalAccessToken(other, "super-secret-key-123!@#") {
+		t.Errorf("Expected two personal access tokens to hash differently")
+	}
+}
+
+func TestEmailVerificationToken(t *testing.T) {
+	verification := EmailVerification{
+		UserID: uuid.MustParse("b3a29e2e-54e4-4b84-a991-07b5f63c2a6a"),
+		Email:  "user@example.com",
+		Nonce:  uuid.New(),
+	}
+	key := "super-secret-key-123!@#"
+
+	token, err := MakeEmailVerificationToken(verification, key, time.Hour)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	got, err := ValidateEmailVerificationToken(token, key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got != verification {
+		t.Errorf("Expected %+v, got %+v", verification, got)
+	}
+
+	if _, err := ValidateEmailVerificationToken(token, "another-secret-key-456$%^"); !errors.Is(err, ErrTokenBadSignature) {
+		t.Errorf("Expected a token signed with another key to fail with %v, got %v", ErrTokenBadSignature, err)
+	}
+
+	expired, _ := MakeEmailVerificationToken(verification, key, -time.Hour)
+	if _, err := ValidateEmailVerificationToken(expired, key); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Expected an expired token to fail with %v, got %v", ErrTokenExpired, err)
+	}
+
+	access_token := mustMakeHS256JWT(t, verification.UserID)
+	if _, err := ValidateEmailVerificationToken(access_token, key); !errors.Is(err, ErrTokenWrongAudience) {
+		t.Errorf("Expected an access token to fail with %v, got %v", ErrTokenWrongAudience, err)
+	}
+	if _, err := validateHS256(token, key); !errors.Is(err, ErrTokenWrongAudience) {
+		t.Errorf("Expected a verification token not to be accepted as an access token, got %v", err)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// the SHA1 vectors of RFC 6238, whose 8 digit codes end with these 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, v := range vectors {
+		code, err := TOTPCode(secret, TOTPStep(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if code != v.code {
+			t.Errorf("Expected code %s at %d, got %s", v.code, v.unix, code)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	step, ok := ValidateTOTP(secret, "081804", now.Add(TOTP_PERIOD), 0)
+	if !ok || step != TOTPStep(now) {
+		t.Errorf("Expected the code of the previous period to be accepted")
+	}
+	if _, ok := ValidateTOTP(secret, "081804", now, step); ok {
+		t.Errorf("Expected a code not to be accepted twice")
+	}
+	if _, ok := ValidateTOTP(secret, "081804", now.Add(5*TOTP_PERIOD), 0); ok {
+		t.Errorf("Expected the code of an old period to be refused")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := MakeRecoveryCodes()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(codes) != RECOVERY_CODE_COUNT {
+		t.Fatalf("Expected %d recovery codes, got %d", RECOVERY_CODE_COUNT, len(codes))
+	}
+
+	key := "super-secret-key-123!@#"
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", " "))
+	if HashRecoveryCode(typed, key) != HashRecoveryCode(codes[0], key) {
+		t.Errorf("Expected %q to hash like %q", typed, codes[0])
+	}
+	if HashRecoveryCode(codes[0], key) == HashRecoveryCode(codes[1], key) {
+		t.Errorf("Expected two recovery codes to hash differently")
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	user_id := uuid.MustParse("b3a29e2e-54e4-4b84-a991-07b5f63c2a6a")
+
+	rsa_private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	rsa_pem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsa_private)})
+	rsa_key, err := ParseSigningKeyPEM("old", rsa_pem)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	_, ed_private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	ed_key, err := NewSigningKey("new", ed_private)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	key_set := NewKeySet()
+	key_set.AddKey(rsa_key)
+	if err := key_set.SetSigningKey("old"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	old_token, err := key_set.MakeJWT(user_id, "user", 15*time.Minute)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// rotate: sign with the new key while the old one keeps verifying
+	key_set.AddKey(ed_key)
+	if err := key_set.SetSigningKey("new"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	new_token, err := key_set.MakeJWT(user_id, "admin", 15*time.Minute)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for token, role := range map[string]string{old_token: "user", new_token: "admin"} {
+		claims, err := key_set.ValidateJWTClaims(token)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if claims.UserID != user_id || claims.Role != role {
+			t.Errorf("Expected user %s with role %s, got %s with role %s", user_id, role, claims.UserID, claims.Role)
+		}
+	}
+
+	jwks := key_set.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != "new" || jwks.Keys[0].Alg != "EdDSA" || jwks.Keys[1].Alg != "RS256" {
+		t.Errorf("Expected the signing key first and both keys published, got %+v", jwks.Keys)
+	}
+
+	key_set.RemoveKey("old")
+	if _, err := key_set.ValidateJWT(old_token); err == nil {
+		t.Errorf("Expected an error for a token signed with a removed key, but got none")
+	}
+
+	if _, err := key_set.ValidateJWT(mustMakeHS256JWT(t, user_id)); err == nil {
+		t.Errorf("Expected an error for an HS256 token, but got none")
+	}
+}
+
+// mustMakeHS256JWT makes an access token the way Chirpy did before its tokens were signed with a KeySet.
+func mustMakeHS256JWT(t *testing.T, user_id uuid.UUID) string {
+	claims := jwt.RegisteredClaims{
+		Issuer:    JWT_ISSUER,
+		Audience:  jwt.ClaimStrings{JWT_AUDIENCE},
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)),
+		Subject:   user_id.String(),
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("super-secret-key-123!@#"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return token
+}
+
+// validateHS256 checks an access token signed with an HMAC key, to test the Validator on its own.
+func validateHS256(token_string string, secret string) (uuid.UUID, error) {
+	claims, err := NewValidator(jwt.SigningMethodHS256).Validate(token_string, func(token *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	})
+	return claims.UserID, err
+}
+
+func TestValidatorErrors(t *testing.T) {
+	secret := "super-secret-key-123!@#"
+	user_id := uuid.MustParse("b3a29e2e-54e4-4b84-a991-07b5f63c2a6a")
+	now := time.Now()
+
+	valid_claims := func() jwt.RegisteredClaims {
+		return jwt.RegisteredClaims{
+			Issuer:    JWT_ISSUER,
+			Audience:  jwt.ClaimStrings{JWT_AUDIENCE},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(15 * time.Minute)),
+			Subject:   user_id.String(),
+		}
+	}
+	sign := func(method jwt.SigningMethod, claims jwt.RegisteredClaims, key string) string {
+		token_string, err := jwt.NewWithClaims(method, claims).SignedString([]byte(key))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return token_string
+	}
+
+	tests := []struct {
+		name     string
+		token    func() string
+		expected error
+	}{
+		{"valid", func() string { return sign(jwt.SigningMethodHS256, valid_claims(), secret) }, nil},
+		{"expired within leeway", func() string {
+			claims := valid_claims()
+			claims.ExpiresAt = jwt.NewNumericDate(now.Add(-10 * time.Second))
+			return sign(jwt.SigningMethodHS256, claims, secret)
+		}, nil},
+		{"expired", func() string {
+			claims := valid_claims()
+			claims.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute))
+			return sign(jwt.SigningMethodHS256, claims, secret)
+		}, ErrTokenExpired},
+		{"not valid yet", func() string {
+			claims := valid_claims()
+			claims.NotBefore = jwt.NewNumericDate(now.Add(time.Minute))
+			return sign(jwt.SigningMethodHS256, claims, secret)
+		}, ErrTokenNotYetValid},
+		{"wrong issuer", func() string {
+			claims := valid_claims()
+			claims.Issuer = "someone-else"
+			return sign(jwt.SigningMethodHS256, claims, secret)
+		}, ErrTokenWrongIssuer},
+		{"wrong audience", func() string {
+			claims := valid_claims()
+			claims.Audience = jwt.ClaimStrings{"another-api"}
+			return sign(jwt.SigningMethodHS256, claims, secret)
+		}, ErrTokenWrongAudience},
+		{"missing expiry", func() string {
+			claims := valid_claims()
+			claims.ExpiresAt = nil
+			return sign(jwt.SigningMethodHS256, claims, secret)
+		}, ErrTokenMissingClaim},
+		{"missing issued at", func() string {
+			claims := valid_claims()
+			claims.IssuedAt = nil
+			return sign(jwt.SigningMethodHS256, claims, secret)
+		}, ErrTokenMissingClaim},
+		{"bad signature", func() string { return sign(jwt.SigningMethodHS256, valid_claims(), "wrong-secret") }, ErrTokenBadSignature},
+		{"wrong algorithm", func() string { return sign(jwt.SigningMethodHS512, valid_claims(), secret) }, ErrTokenWrongAlgorithm},
+		{"malformed", func() string { return "not-a-jwt" }, ErrTokenMalformed},
+	}
+
+	for _, test := range tests {
+		validated_id, err := validateHS256(test.token(), secret)
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			} else if validated_id != user_id {
+				t.Errorf("%s: expected user %s, got %s", test.name, user_id, validated_id)
+			}
+			continue
+		}
+
+		var token_error *TokenError
+		if !errors.As(err, &token_error) || !errors.Is(err, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+}
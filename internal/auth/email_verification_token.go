@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// EMAIL_VERIFICATION_AUDIENCE keeps verification tokens from being accepted as access tokens, and the other way around.
+const EMAIL_VERIFICATION_AUDIENCE = "chirpy-email-verification"
+
+type emailVerificationClaims struct {
+	jwt.RegisteredClaims
+	Email string `json:"email"`
+}
+
+// EmailVerification is what a verification token vouches for: that its user received mail at Email.
+// Nonce is the token's jti, which the caller stores to make the token single-use.
+type EmailVerification struct {
+	UserID uuid.UUID
+	Email  string
+	Nonce  uuid.UUID
+}
+
+// MakeEmailVerificationToken signs an HS256 token for the link sent to a user's address.
+func MakeEmailVerificationToken(verification EmailVerification, key string, expiresIn time.Duration) (string, error) {
+	claims := emailVerificationClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    JWT_ISSUER,
+			Audience:  jwt.ClaimStrings{EMAIL_VERIFICATION_AUDIENCE},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+			Subject:   verification.UserID.String(),
+			ID:        verification.Nonce.String(),
+		},
+		Email: verification.Email,
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(key))
+	if err != nil {
+		return "", errors.New("Error while signing email verification token: " + err.Error())
+	}
+	return token, nil
+}
+
+// ValidateEmailVerificationToken checks the signature and expiry of a verification token.
+// Whether it was already used is up to the caller, by comparing Nonce with the one it stored.
+func ValidateEmailVerificationToken(tokenString string, key string) (EmailVerification, error) {
+	claims := &emailVerificationClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(key), nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(JWT_ISSUER),
+		jwt.WithAudience(EMAIL_VERIFICATION_AUDIENCE),
+		jwt.WithLeeway(DEFAULT_JWT_LEEWAY),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return EmailVerification{}, newTokenError(err, &claims.RegisteredClaims)
+	}
+
+	user_id, err2 := uuid.Parse(claims.Subject)
+	if err2 != nil {
+		return EmailVerification{}, &TokenError{Kind: ErrTokenMissingClaim, Detail: "sub isn't a user id: " + err2.Error()}
+	}
+	nonce, err3 := uuid.Parse(claims.ID)
+	if err3 != nil {
+		return EmailVerification{}, &TokenError{Kind: ErrTokenMissingClaim, Detail: "jti isn't a uuid: " + err3.Error()}
+	}
+
+	return EmailVerification{UserID: user_id, Email: claims.Email, Nonce: nonce}, nil
+}
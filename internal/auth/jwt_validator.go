@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const JWT_ISSUER = "chirpy"
+const JWT_AUDIENCE = "chirpy-api"
+
+// DEFAULT_JWT_LEEWAY is the clock skew tolerated between Chirpy and the services verifying its tokens.
+const DEFAULT_JWT_LEEWAY = 30 * time.Second
+
+// The kinds of TokenError, to be compared with errors.Is.
+var (
+	ErrTokenMalformed      = errors.New("token is malformed")
+	ErrTokenWrongAlgorithm = errors.New("token is signed with an algorithm that isn't allowed")
+	ErrTokenUnknownKey     = errors.New("token is signed with an unknown key")
+	ErrTokenBadSignature   = errors.New("token signature is invalid")
+	ErrTokenMissingClaim   = errors.New("token is missing a required claim")
+	ErrTokenExpired        = errors.New("token is expired")
+	ErrTokenNotYetValid    = errors.New("token is not valid yet")
+	ErrTokenWrongIssuer    = errors.New("token has the wrong issuer")
+	ErrTokenWrongAudience  = errors.New("token has the wrong audience")
+)
+
+// TokenError explains why a token was rejected. Kind is one of the ErrToken* errors and Detail what exactly was wrong.
+type TokenError struct {
+	Kind   error
+	Detail string
+}
+
+func (e *TokenError) Error() string {
+	if e.Detail == "" {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Detail
+}
+
+func (e *TokenError) Unwrap() error {
+	return e.Kind
+}
+
+// accessTokenClaims are the claims of an access token: the registered ones plus the role of its user.
+type accessTokenClaims struct {
+	jwt.RegisteredClaims
+	Role string `json:"role,omitempty"`
+}
+
+// TokenClaims is what a validated access token says about its user.
+type TokenClaims struct {
+	UserID    uuid.UUID
+	Role      string
+	ExpiresAt time.Time
+}
+
+// Validator checks everything about an access token, not just its signature:
+// the algorithm must be one of Methods, iss and aud must match, and exp, iat and sub must be present.
+// exp, nbf and iat are checked with Leeway of tolerance.
+type Validator struct {
+	Issuer   string
+	Audience string
+	Methods  []string
+	Leeway   time.Duration
+}
+
+func NewValidator(methods ...jwt.SigningMethod) Validator {
+	validator := Validator{
+		Issuer:   JWT_ISSUER,
+		Audience: JWT_AUDIENCE,
+		Leeway:   DEFAULT_JWT_LEEWAY,
+	}
+	for _, method := range methods {
+		validator.Methods = append(validator.Methods, method.Alg())
+	}
+	return validator
+}
+
+// Validate checks the token with the key keyfunc picks for it, and returns what it says about its user.
+func (v Validator) Validate(tokenString string, keyfunc jwt.Keyfunc) (TokenClaims, error) {
+	if len(v.Methods) == 0 {
+		return TokenClaims{}, errors.New("No signing algorithm is allowed")
+	}
+
+	claims := &accessTokenClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		// checked here rather than with jwt.WithValidMethods, which reports a wrong algorithm as a bad signature
+		if !slices.Contains(v.Methods, token.Method.Alg()) {
+			return nil, &TokenError{Kind: ErrTokenWrongAlgorithm, Detail: token.Method.Alg()}
+		}
+		return keyfunc(token)
+	},
+		jwt.WithIssuer(v.Issuer),
+		jwt.WithAudience(v.Audience),
+		jwt.WithLeeway(v.Leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return TokenClaims{}, newTokenError(err, &claims.RegisteredClaims)
+	}
+
+	if claims.IssuedAt == nil {
+		return TokenClaims{}, &TokenError{Kind: ErrTokenMissingClaim, Detail: "iat"}
+	}
+
+	user_id, err2 := uuid.Parse(claims.Subject)
+	if err2 != nil {
+		return TokenClaims{}, &TokenError{Kind: ErrTokenMissingClaim, Detail: "sub isn't a user id: " + err2.Error()}
+	}
+
+	return TokenClaims{
+		UserID:    user_id,
+		Role:      claims.Role,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
+}
+
+// newTokenError sorts the errors of the jwt package into the kinds of TokenError.
+func newTokenError(err error, claims *jwt.RegisteredClaims) error {
+	var token_error *TokenError
+	if errors.As(err, &token_error) {
+		return token_error
+	}
+
+	kinds := []struct {
+		jwt_error error
+		kind      error
+	}{
+		{jwt.ErrTokenMalformed, ErrTokenMalformed},
+		{jwt.ErrTokenSignatureInvalid, ErrTokenBadSignature},
+		{jwt.ErrTokenUnverifiable, ErrTokenBadSignature},
+		{jwt.ErrTokenRequiredClaimMissing, ErrTokenMissingClaim},
+		{jwt.ErrTokenExpired, ErrTokenExpired},
+		{jwt.ErrTokenNotValidYet, ErrTokenNotYetValid},
+		{jwt.ErrTokenUsedBeforeIssued, ErrTokenNotYetValid},
+		{jwt.ErrTokenInvalidIssuer, ErrTokenWrongIssuer},
+		{jwt.ErrTokenInvalidAudience, ErrTokenWrongAudience},
+	}
+	for _, k := range kinds {
+		if !errors.Is(err, k.jwt_error) {
+			continue
+		}
+		switch k.kind {
+		case ErrTokenExpired:
+			return &TokenError{Kind: k.kind, Detail: fmt.Sprintf("expired at %v", claims.ExpiresAt.Time)}
+		case ErrTokenMalformed, ErrTokenBadSignature, ErrTokenMissingClaim:
+			return &TokenError{Kind: k.kind, Detail: err.Error()}
+		}
+		return &TokenError{Kind: k.kind}
+	}
+
+	return fmt.Errorf("Error while parsing token string: %w", err)
+}
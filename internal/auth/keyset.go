@@ -0,0 +1,316 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const MIN_RSA_KEY_BITS = 2048
+
+// SigningKey is one key of a KeySet. Keys without a private half can only verify tokens,
+// which is how a retired key is kept around until the tokens it signed have expired.
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// KeySet signs access tokens with its current key and verifies them with any of its keys, picked by the token's kid header.
+// Only public keys are ever published, so other services can verify Chirpy's tokens without being able to issue them.
+type KeySet struct {
+	// Validator checks the claims of the tokens; its Issuer and Audience are also what new tokens are issued with.
+	Validator Validator
+
+	mu         sync.RWMutex
+	signing_id string
+	keys       map[string]SigningKey
+}
+
+// JWK is the public half of a key in the JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func NewKeySet() *KeySet {
+	return &KeySet{
+		Validator: NewValidator(jwt.SigningMethodRS256, jwt.SigningMethodEdDSA),
+		keys:      map[string]SigningKey{},
+	}
+}
+
+// NewSigningKey wraps a private or public RSA / Ed25519 key, picking RS256 or EdDSA from its type.
+func NewSigningKey(id string, key any) (SigningKey, error) {
+	if id == "" {
+		return SigningKey{}, errors.New("Signing key needs an id")
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < MIN_RSA_KEY_BITS {
+			return SigningKey{}, fmt.Errorf("RSA key %s is %d bits, at least %d are required", id, key.N.BitLen(), MIN_RSA_KEY_BITS)
+		}
+		return SigningKey{ID: id, Method: jwt.SigningMethodRS256, Private: key, Public: &key.PublicKey}, nil
+	case *rsa.PublicKey:
+		if key.N.BitLen() < MIN_RSA_KEY_BITS {
+			return SigningKey{}, fmt.Errorf("RSA key %s is %d bits, at least %d are required", id, key.N.BitLen(), MIN_RSA_KEY_BITS)
+		}
+		return SigningKey{ID: id, Method: jwt.SigningMethodRS256, Public: key}, nil
+	case ed25519.PrivateKey:
+		return SigningKey{ID: id, Method: jwt.SigningMethodEdDSA, Private: key, Public: key.Public()}, nil
+	case ed25519.PublicKey:
+		return SigningKey{ID: id, Method: jwt.SigningMethodEdDSA, Public: key}, nil
+	}
+
+	return SigningKey{}, fmt.Errorf("Key %s has an unsupported type %T, only RSA and Ed25519 keys are supported", id, key)
+}
+
+// ParseSigningKeyPEM reads a PKCS#8 or PKCS#1 private key, or a PKIX public key for a verification-only key.
+func ParseSigningKeyPEM(id string, data []byte) (SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, fmt.Errorf("Key %s isn't PEM encoded", id)
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return SigningKey{}, fmt.Errorf("Key %s has an unsupported PEM block type %q", id, block.Type)
+	}
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("Error while parsing key %s: %v", id, err)
+	}
+
+	return NewSigningKey(id, key)
+}
+
+// LoadKeySet loads every <kid>.pem file of dir. signingID names the key that signs new tokens;
+// it can be left empty when dir holds a single private key.
+func LoadKeySet(dir string, signingID string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, errors.New("Error while listing signing keys: " + err.Error())
+	}
+	sort.Strings(paths)
+
+	key_set := NewKeySet()
+	private_ids := []string{}
+	for _, path := range paths {
+		data, err2 := os.ReadFile(path)
+		if err2 != nil {
+			return nil, errors.New("Error while reading signing key: " + err2.Error())
+		}
+
+		key, err3 := ParseSigningKeyPEM(strings.TrimSuffix(filepath.Base(path), ".pem"), data)
+		if err3 != nil {
+			return nil, err3
+		}
+		key_set.AddKey(key)
+		if key.Private != nil {
+			private_ids = append(private_ids, key.ID)
+		}
+	}
+
+	if signingID == "" {
+		if len(private_ids) != 1 {
+			return nil, fmt.Errorf("Found %d private keys in %s, choose the one that signs tokens", len(private_ids), dir)
+		}
+		signingID = private_ids[0]
+	}
+
+	if err4 := key_set.SetSigningKey(signingID); err4 != nil {
+		return nil, err4
+	}
+	return key_set, nil
+}
+
+// GenerateKeySet creates a key set holding a single new Ed25519 key.
+// Its tokens can't be verified once the process exits, so it's only meant for development and tests.
+func GenerateKeySet() (*KeySet, error) {
+	_, private_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.New("Error while generating signing key: " + err.Error())
+	}
+
+	key, err2 := NewSigningKey("dev-"+uuid.NewString()[:8], private_key)
+	if err2 != nil {
+		return nil, err2
+	}
+
+	key_set := NewKeySet()
+	key_set.AddKey(key)
+	if err3 := key_set.SetSigningKey(key.ID); err3 != nil {
+		return nil, err3
+	}
+	return key_set, nil
+}
+
+// AddKey adds a key, or replaces the key with the same id.
+func (ks *KeySet) AddKey(key SigningKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.keys[key.ID] = key
+}
+
+// RemoveKey retires a key: tokens signed with it stop validating.
+func (ks *KeySet) RemoveKey(id string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	delete(ks.keys, id)
+	if ks.signing_id == id {
+		ks.signing_id = ""
+	}
+}
+
+// SetSigningKey switches the key new tokens are signed with; the previous one keeps verifying the tokens it signed.
+func (ks *KeySet) SetSigningKey(id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	key, ok := ks.keys[id]
+	if !ok {
+		return fmt.Errorf("No signing key with id %s", id)
+	}
+	if key.Private == nil {
+		return fmt.Errorf("Key %s has no private key, it can only verify tokens", id)
+	}
+
+	ks.signing_id = id
+	return nil
+}
+
+// MakeJWT issues an access token for the user, carrying their role so authorization checks don't need the database.
+func (ks *KeySet) MakeJWT(userID uuid.UUID, role string, expiresIn time.Duration) (string, error) {
+	ks.mu.RLock()
+	key, ok := ks.keys[ks.signing_id]
+	ks.mu.RUnlock()
+	if !ok {
+		return "", errors.New("No signing key is configured")
+	}
+
+	claims := accessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    ks.Validator.Issuer,
+			Audience:  jwt.ClaimStrings{ks.Validator.Audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+			Subject:   userID.String(),
+		},
+		Role: role,
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+
+	jwtString, err := token.SignedString(key.Private)
+	if err != nil {
+		return "", errors.New("Error while signing jwt string: " + err.Error())
+	}
+
+	return jwtString, nil
+}
+
+func (ks *KeySet) ValidateJWT(tokenString string) (uuid.UUID, error) {
+	claims, err := ks.ValidateJWTClaims(tokenString)
+	return claims.UserID, err
+}
+
+func (ks *KeySet) ValidateJWTWithExpiry(tokenString string) (uuid.UUID, time.Time, error) {
+	claims, err := ks.ValidateJWTClaims(tokenString)
+	return claims.UserID, claims.ExpiresAt, err
+}
+
+func (ks *KeySet) ValidateJWTClaims(tokenString string) (TokenClaims, error) {
+	return ks.Validator.Validate(tokenString, ks.verificationKey)
+}
+
+// verificationKey picks the public key named by the token's kid, and only accepts the algorithm that key is meant for.
+func (ks *KeySet) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, &TokenError{Kind: ErrTokenUnknownKey, Detail: "no kid header"}
+	}
+
+	ks.mu.RLock()
+	key, ok := ks.keys[kid]
+	ks.mu.RUnlock()
+	if !ok {
+		return nil, &TokenError{Kind: ErrTokenUnknownKey, Detail: kid}
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, &TokenError{Kind: ErrTokenWrongAlgorithm, Detail: fmt.Sprintf("key %s signs with %s, not %s", kid, key.Method.Alg(), token.Method.Alg())}
+	}
+
+	return key.Public, nil
+}
+
+// JWKS lists the public half of every key, the signing key first.
+func (ks *KeySet) JWKS() JWKSet {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	ids := []string{}
+	for id := range ks.keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if (ids[i] == ks.signing_id) != (ids[j] == ks.signing_id) {
+			return ids[i] == ks.signing_id
+		}
+		return ids[i] < ids[j]
+	})
+
+	jwk_set := JWKSet{Keys: []JWK{}}
+	for _, id := range ids {
+		key := ks.keys[id]
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch public_key := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public_key.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public_key.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public_key)
+		}
+		jwk_set.Keys = append(jwk_set.Keys, jwk)
+	}
+	return jwk_set
+}
@@ -1,23 +1,174 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Argon2idParams are the cost of new password hashes. Every hash records the parameters it was made with,
+// so they can change at any time: older hashes still check out, and get upgraded at the next login (see PasswordNeedsRehash).
+type Argon2idParams struct {
+	Memory      uint32 // in KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idParams follow RFC 9106's second recommended option, for machines without much memory to spare.
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// LEGACY_UNSET_PASSWORD_HASH is the hashed_password default of the 003_users migration, for users made before passwords existed.
+const LEGACY_UNSET_PASSWORD_HASH = "unset"
+
+const ARGON2ID_HASH_PREFIX = "$argon2id$"
+
+var passwordHashParams = DefaultArgon2idParams
+
+// SetPasswordHashParams changes the parameters of the hashes HashPassword makes from now on.
+// Call it at startup, before any password is hashed or checked.
+func SetPasswordHashParams(params Argon2idParams) error {
+	if params.Memory < 8*uint32(params.Parallelism) || params.Iterations < 1 || params.Parallelism < 1 {
+		return errors.New("Argon2id needs at least 1 iteration, 1 thread and 8 KiB of memory per thread")
+	}
+	if params.SaltLength < 16 || params.KeyLength < 16 {
+		return errors.New("Argon2id salt and key need at least 16 bytes")
+	}
+	passwordHashParams = params
+	return nil
+}
+
+// HashPassword hashes with argon2id, in the PHC string format: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>.
+// Unlike bcrypt, argon2id uses the whole password, however long.
 func HashPassword(password string) (string, error) {
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
+	params := passwordHashParams
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
 		return "", errors.New("Error while hashing password: " + err.Error())
 	}
-	return string(hashed), nil
+
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", ARGON2ID_HASH_PREFIX, argon2.Version,
+		params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
 }
 
+// CheckPasswordHash checks a password against an argon2id hash, or a bcrypt one from before argon2id.
+// Any other hash, the legacy "unset" one included, matches no password.
 func CheckPasswordHash(password, hash string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	switch {
+	case hash == LEGACY_UNSET_PASSWORD_HASH:
+		return errors.New("This user has no password set")
+	case strings.HasPrefix(hash, ARGON2ID_HASH_PREFIX):
+		params, salt, key, err := parseArgon2idHash(hash)
+		if err != nil {
+			return err
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return errors.New("Error while comparing password with hash (Didn't Match)")
+		}
+		return nil
+	case isBcryptHash(hash):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err != nil {
+			return errors.New("Error while comparing password with hash (Didn't Match): " + err.Error())
+		}
+		return nil
+	default:
+		return errors.New("Password hash is in an unknown format")
+	}
+}
+
+// PasswordNeedsRehash tells whether a hash that just checked out should be replaced by a new HashPassword of the same password:
+// it's a bcrypt hash, or an argon2id one made with other parameters than the current ones.
+func PasswordNeedsRehash(hash string) bool {
+	if !strings.HasPrefix(hash, ARGON2ID_HASH_PREFIX) {
+		return true
+	}
+	params, salt, _, err := parseArgon2idHash(hash)
 	if err != nil {
-		return errors.New("Error while comparing password with hash (Didn't Match): " + err.Error())
+		return true
 	}
-	return nil
+	current := passwordHashParams
+	return params.Memory != current.Memory || params.Iterations != current.Iterations ||
+		params.Parallelism != current.Parallelism || params.KeyLength != current.KeyLength ||
+		uint32(len(salt)) != current.SaltLength
+}
+
+func parseArgon2idHash(hash string) (Argon2idParams, []byte, []byte, error) {
+	params := Argon2idParams{}
+	invalid := errors.New("Password hash isn't a valid argon2id hash")
+
+	// "", "argon2id", "v=19", "m=65536,t=3,p=4", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, invalid
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("Password hash is of an unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, invalid
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, invalid
+	}
+	key, err2 := base64.RawStdEncoding.DecodeString(parts[5])
+	if err2 != nil || len(key) == 0 || params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, invalid
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// dummyHash is what SimulatePasswordCheck compares with; it's made on first use so it has the current parameters.
+var dummyHash = sync.OnceValue(func() string {
+	hashed, _ := HashPassword("chirpy-dummy-password")
+	return hashed
+})
+
+// SimulatePasswordCheck takes as long as CheckPasswordHash, for logins whose email matches no user:
+// answering them faster would tell which emails have an account.
+func SimulatePasswordCheck(password string) {
+	CheckPasswordHash(password, dummyHash())
+}
+
+// LoginBackoff is how long logins stay locked after failures consecutive failures.
+// The first free failures don't lock anything; after that the lock starts at base and doubles with every failure, up to max.
+func LoginBackoff(failures int, free int, base time.Duration, max time.Duration) time.Duration {
+	if failures <= free {
+		return 0
+	}
+
+	backoff := base
+	for i := free + 1; i < failures; i++ {
+		backoff *= 2
+		if backoff >= max {
+			return max
+		}
+	}
+	return min(backoff, max)
 }
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Password character classes a PasswordPolicy can require.
+const PASSWORD_CLASS_LOWERCASE = "lowercase"
+const PASSWORD_CLASS_UPPERCASE = "uppercase"
+const PASSWORD_CLASS_DIGIT = "digit"
+const PASSWORD_CLASS_SYMBOL = "symbol"
+
+// Rules a password can fail, as reported in PasswordPolicyViolation.Rule.
+const PASSWORD_RULE_MIN_LENGTH = "min_length"
+const PASSWORD_RULE_CHARACTER_CLASS = "character_class"
+const PASSWORD_RULE_CONTAINS_EMAIL = "contains_email"
+const PASSWORD_RULE_BREACHED = "breached"
+
+// PasswordPolicy is what new passwords must satisfy. Existing passwords aren't checked again, so it can be tightened at any time.
+type PasswordPolicy struct {
+	MinLength       int      // in characters, not bytes
+	RequiredClasses []string // PASSWORD_CLASS_* constants
+	ForbidEmail     bool     // refuse passwords containing the email address or its part before the @
+	ForbidBreached  bool     // refuse the passwords of the bundled breached password list
+}
+
+// DefaultPasswordPolicy follows NIST SP 800-63B: length and a breached password list rather than character classes,
+// which mostly push people to "Password1!".
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:      8,
+	ForbidEmail:    true,
+	ForbidBreached: true,
+}
+
+type PasswordPolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+//go:embed breached_passwords.txt
+var breachedPasswordsFile string
+
+var breachedPasswords = sync.OnceValue(func() map[string]bool {
+	passwords := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(breachedPasswordsFile))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			passwords[line] = true
+		}
+	}
+	return passwords
+})
+
+// ParsePasswordClasses reads a comma separated list of character classes, such as "lowercase,digit".
+func ParsePasswordClasses(list string) ([]string, error) {
+	classes := []string{}
+	for _, class := range strings.Split(list, ",") {
+		class = strings.ToLower(strings.TrimSpace(class))
+		switch class {
+		case "":
+			continue
+		case PASSWORD_CLASS_LOWERCASE, PASSWORD_CLASS_UPPERCASE, PASSWORD_CLASS_DIGIT, PASSWORD_CLASS_SYMBOL:
+			classes = append(classes, class)
+		default:
+			return nil, errors.New("Unknown password character class: " + class)
+		}
+	}
+	return classes, nil
+}
+
+// Check returns every rule the password breaks, none when it's acceptable. email is the address of the account, "" when unknown.
+func (policy PasswordPolicy) Check(password string, email string) []PasswordPolicyViolation {
+	violations := []PasswordPolicyViolation{}
+
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		violations = append(violations, PasswordPolicyViolation{
+			Rule:    PASSWORD_RULE_MIN_LENGTH,
+			Message: fmt.Sprintf("Password must be at least %d characters long", policy.MinLength),
+		})
+	}
+
+	for _, class := range policy.RequiredClasses {
+		if !strings.ContainsFunc(password, passwordClassMatcher(class)) {
+			violations = append(violations, PasswordPolicyViolation{
+				Rule:    PASSWORD_RULE_CHARACTER_CLASS,
+				Message: "Password must contain " + passwordClassName(class),
+			})
+		}
+	}
+
+	if policy.ForbidEmail && passwordContainsEmail(password, email) {
+		violations = append(violations, PasswordPolicyViolation{
+			Rule:    PASSWORD_RULE_CONTAINS_EMAIL,
+			Message: "Password must not contain your email address",
+		})
+	}
+
+	if policy.ForbidBreached && breachedPasswords()[strings.ToLower(password)] {
+		violations = append(violations, PasswordPolicyViolation{
+			Rule:    PASSWORD_RULE_BREACHED,
+			Message: "Password is too common, it appears in lists of breached passwords",
+		})
+	}
+
+	return violations
+}
+
+func passwordClassMatcher(class string) func(rune) bool {
+	switch class {
+	case PASSWORD_CLASS_LOWERCASE:
+		return unicode.IsLower
+	case PASSWORD_CLASS_UPPERCASE:
+		return unicode.IsUpper
+	case PASSWORD_CLASS_DIGIT:
+		return unicode.IsDigit
+	default:
+		return func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+		}
+	}
+}
+
+func passwordClassName(class string) string {
+	switch class {
+	case PASSWORD_CLASS_LOWERCASE:
+		return "a lowercase letter"
+	case PASSWORD_CLASS_UPPERCASE:
+		return "an uppercase letter"
+	case PASSWORD_CLASS_DIGIT:
+		return "a digit"
+	default:
+		return "a symbol"
+	}
+}
+
+// passwordContainsEmail also catches the part before the @, which is usually the easiest part of it to guess.
+// Parts shorter than 3 characters are ignored: "jo@example.com" shouldn't forbid every password with "jo" in it.
+func passwordContainsEmail(password string, email string) bool {
+	email = strings.ToLower(strings.TrimSpace(email))
+	password = strings.ToLower(password)
+	if email == "" {
+		return false
+	}
+	if strings.Contains(password, email) {
+		return true
+	}
+	local, _, _ := strings.Cut(email, "@")
+	return len(local) >= 3 && strings.Contains(password, local)
+}
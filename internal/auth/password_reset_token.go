@@ -0,0 +1,10 @@
+package auth
+
+func MakePasswordResetToken() (string, error) {
+	return makeRandomToken()
+}
+
+// HashPasswordResetToken is what gets stored for a password reset token, the same keyed hash as HashRefreshToken.
+func HashPasswordResetToken(token string, key string) string {
+	return hashToken(token, key)
+}
@@ -0,0 +1,25 @@
+package auth
+
+import (
+	"strings"
+)
+
+// PERSONAL_ACCESS_TOKEN_PREFIX tells personal access tokens apart from JWTs, and makes leaked ones easy to scan for.
+const PERSONAL_ACCESS_TOKEN_PREFIX = "chirpy_pat_"
+
+func MakePersonalAccessToken() (string, error) {
+	token, err := makeRandomToken()
+	if err != nil {
+		return "", err
+	}
+	return PERSONAL_ACCESS_TOKEN_PREFIX + token, nil
+}
+
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PERSONAL_ACCESS_TOKEN_PREFIX)
+}
+
+// HashPersonalAccessToken is what gets stored for a personal access token, the same keyed hash as HashRefreshToken.
+func HashPersonalAccessToken(token string, key string) string {
+	return hashToken(token, key)
+}
@@ -1,21 +1,35 @@
 package auth
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 )
 
 func MakeRefreshToken() (string, error) {
+	return makeRandomToken()
+}
+
+// HashRefreshToken is what gets stored for a refresh token: an HMAC-SHA256 keyed with the server's secret,
+// so neither a database dump nor someone who can write to the database without the key can produce a usable token.
+func HashRefreshToken(token string, key string) string {
+	return hashToken(token, key)
+}
+
+func hashToken(token string, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// makeRandomToken makes the 32 random bytes, hex encoded, of the tokens that are only ever stored hashed.
+func makeRandomToken() (string, error) {
 	random_32_byte := make([]byte, 32)
-	n, err := rand.Read(random_32_byte)
-	if err != nil {
+	if _, err := rand.Read(random_32_byte); err != nil {
 		return "", errors.New("Error while generating random 32 byte using rand.Read: " + err.Error())
 	}
-	if n != 32 {
-		return "", errors.New("the generating random slice of bytes using rand.Read isn't exactly 32 byte")
-	}
 
-	refresh_token_hex_string := hex.EncodeToString(random_32_byte)
-	return refresh_token_hex_string, nil
+	return hex.EncodeToString(random_32_byte), nil
 }
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238). They're the defaults of every authenticator app, so they aren't put in the provisioning URI.
+const TOTP_PERIOD = 30 * time.Second
+const TOTP_DIGITS = 6
+
+// TOTP_SKEW is how many periods before and after the current one are still accepted, for clocks that drift.
+const TOTP_SKEW = 1
+
+const RECOVERY_CODE_COUNT = 10
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret makes a 160 bit secret, base32 encoded the way authenticator apps expect it.
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", errors.New("Error while generating TOTP secret: " + err.Error())
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPProvisioningURI is the otpauth:// URI an authenticator app reads, usually from a QR code.
+func TOTPProvisioningURI(secret string, issuer string, account string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// TOTPStep is the number of the period t falls in.
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTP_PERIOD/time.Second)
+}
+
+// TOTPCode is the code of the given period (RFC 4226's HOTP, with the period as counter).
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", errors.New("TOTP secret isn't base32 encoded: " + err.Error())
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for range TOTP_DIGITS {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulus), nil
+}
+
+// ValidateTOTP checks code against the periods around t, and returns the period it matched.
+// Periods up to lastStep are refused, so a code can't be used twice; pass 0 when none was used yet.
+func ValidateTOTP(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+
+	current := TOTPStep(t)
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// MakeRecoveryCodes makes the one-time codes that replace an authenticator app that was lost.
+// They look like "k7d2m-q9x4t" and are only shown to the user once; store HashRecoveryCode of them.
+func MakeRecoveryCodes() ([]string, error) {
+	codes := []string{}
+	for range RECOVERY_CODE_COUNT {
+		random := make([]byte, 7)
+		if _, err := rand.Read(random); err != nil {
+			return nil, errors.New("Error while generating recovery code: " + err.Error())
+		}
+		encoded := strings.ToLower(totpEncoding.EncodeToString(random))[:10]
+		codes = append(codes, encoded[:5]+"-"+encoded[5:])
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode is what gets stored for a recovery code, the same keyed hash as HashRefreshToken.
+// Case, dashes and spaces don't matter, since people type these codes in.
+func HashRecoveryCode(code string, key string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(normalized, key)
+}
+
+// MakeTwoFactorChallengeToken makes the token a login gets once the password checked out, to be traded with a code for the real tokens.
+func MakeTwoFactorChallengeToken() (string, error) {
+	return makeRandomToken()
+}
+
+// HashTwoFactorChallengeToken is what gets stored for a two-factor challenge token, the same keyed hash as HashRefreshToken.
+func HashTwoFactorChallengeToken(token string, key string) string {
+	return hashToken(token, key)
+}
@@ -14,24 +14,26 @@ import (
 )
 
 const createUser = `-- name: CreateUser :one
-INSERT INTO users (id, created_at, updated_at, email, hashed_password)
-VALUES (
-    gen_random_uuid(),
+INSERT INTO users (id, created_at, updated_at, email, hashed_password, handle)
+SELECT
+    new_user.id,
     NOW(),
     NOW(),
     $1,
-    $2
-)
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+    $2,
+    COALESCE($3, 'user_' || substr(replace(new_user.id::text, '-', ''), 1, 12))
+FROM (SELECT gen_random_uuid() AS id) AS new_user
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, handle, role, email_verified, email_verification_nonce, totp_secret, totp_enabled, totp_last_step
 `
 
 type CreateUserParams struct {
 	Email          string
 	HashedPassword string
+	Handle         sql.NullString
 }
 
 func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, error) {
-	row := q.db.QueryRowContext(ctx, createUser, arg.Email, arg.HashedPassword)
+	row := q.db.QueryRowContext(ctx, createUser, arg.Email, arg.HashedPassword, arg.Handle)
 	var i User
 	err := row.Scan(
 		&i.ID,
@@ -40,6 +42,13 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, e
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.Handle,
+		&i.Role,
+		&i.EmailVerified,
+		&i.EmailVerificationNonce,
+		&i.TotpSecret,
+		&i.TotpEnabled,
+		&i.TotpLastStep,
 	)
 	return i, err
 }
@@ -54,7 +63,7 @@ func (q *Queries) DeleteAllUsers(ctx context.Context) error {
 }
 
 const getUserByEmail = `-- name: GetUserByEmail :one
-SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red FROM users
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, handle, role, email_verified, email_verification_nonce, totp_secret, totp_enabled, totp_last_step FROM users
 WHERE email = $1
 `
 
@@ -68,35 +77,103 @@ func (q *Queries) GetUserByEmail(ctx context.Context, email string) (User, error
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.Handle,
+		&i.Role,
+		&i.EmailVerified,
+		&i.EmailVerificationNonce,
+		&i.TotpSecret,
+		&i.TotpEnabled,
+		&i.TotpLastStep,
+	)
+	return i, err
+}
+
+const getUserByHandle = `-- name: GetUserByHandle :one
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, handle, role, email_verified, email_verification_nonce, totp_secret, totp_enabled, totp_last_step FROM users
+WHERE handle = $1
+`
+
+func (q *Queries) GetUserByHandle(ctx context.Context, handle string) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserByHandle, handle)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.Handle,
+		&i.Role,
+		&i.EmailVerified,
+		&i.EmailVerificationNonce,
+		&i.TotpSecret,
+		&i.TotpEnabled,
+		&i.TotpLastStep,
+	)
+	return i, err
+}
+
+const getUserById = `-- name: GetUserById :one
+SELECT id, created_at, updated_at, email, hashed_password, is_chirpy_red, handle, role, email_verified, email_verification_nonce, totp_secret, totp_enabled, totp_last_step FROM users
+WHERE id = $1
+`
+
+func (q *Queries) GetUserById(ctx context.Context, id uuid.UUID) (User, error) {
+	row := q.db.QueryRowContext(ctx, getUserById, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.Email,
+		&i.HashedPassword,
+		&i.IsChirpyRed,
+		&i.Handle,
+		&i.Role,
+		&i.EmailVerified,
+		&i.EmailVerificationNonce,
+		&i.TotpSecret,
+		&i.TotpEnabled,
+		&i.TotpLastStep,
 	)
 	return i, err
 }
 
 const getUserFromRefreshToken = `-- name: GetUserFromRefreshToken :one
-SELECT users.id, users.created_at, users.updated_at, users.email, users.hashed_password, users.is_chirpy_red, refresh_tokens.token, refresh_tokens.created_at, refresh_tokens.updated_at, refresh_tokens.user_id, refresh_tokens.expires_at, refresh_tokens.revoked_at
+SELECT users.id, users.created_at, users.updated_at, users.email, users.hashed_password, users.is_chirpy_red, users.handle, users.role, users.email_verified, users.email_verification_nonce, users.totp_secret, users.totp_enabled, users.totp_last_step, refresh_tokens.token_hash, refresh_tokens.created_at, refresh_tokens.updated_at, refresh_tokens.user_id, refresh_tokens.expires_at, refresh_tokens.revoked_at, refresh_tokens.family_id, refresh_tokens.replaced_by
 FROM users
 INNER JOIN refresh_tokens ON users.id = refresh_tokens.user_id
-WHERE refresh_tokens.token = $1
+WHERE refresh_tokens.token_hash = $1
 LIMIT 1
 `
 
 type GetUserFromRefreshTokenRow struct {
-	ID             uuid.UUID
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
-	Email          string
-	HashedPassword string
-	IsChirpyRed    bool
-	Token          string
-	CreatedAt_2    time.Time
-	UpdatedAt_2    time.Time
-	UserID         uuid.UUID
-	ExpiresAt      time.Time
-	RevokedAt      sql.NullTime
+	ID                     uuid.UUID
+	CreatedAt              time.Time
+	UpdatedAt              time.Time
+	Email                  string
+	HashedPassword         string
+	IsChirpyRed            bool
+	Handle                 string
+	Role                   string
+	EmailVerified          bool
+	EmailVerificationNonce uuid.NullUUID
+	TotpSecret             sql.NullString
+	TotpEnabled            bool
+	TotpLastStep           int64
+	TokenHash              string
+	CreatedAt_2            time.Time
+	UpdatedAt_2            time.Time
+	UserID                 uuid.UUID
+	ExpiresAt              time.Time
+	RevokedAt              sql.NullTime
+	FamilyID               uuid.UUID
+	ReplacedBy             sql.NullString
 }
 
-func (q *Queries) GetUserFromRefreshToken(ctx context.Context, token string) (GetUserFromRefreshTokenRow, error) {
-	row := q.db.QueryRowContext(ctx, getUserFromRefreshToken, token)
+func (q *Queries) GetUserFromRefreshToken(ctx context.Context, tokenHash string) (GetUserFromRefreshTokenRow, error) {
+	row := q.db.QueryRowContext(ctx, getUserFromRefreshToken, tokenHash)
 	var i GetUserFromRefreshTokenRow
 	err := row.Scan(
 		&i.ID,
@@ -105,31 +182,82 @@ func (q *Queries) GetUserFromRefreshToken(ctx context.Context, token string) (Ge
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
-		&i.Token,
+		&i.Handle,
+		&i.Role,
+		&i.EmailVerified,
+		&i.EmailVerificationNonce,
+		&i.TotpSecret,
+		&i.TotpEnabled,
+		&i.TotpLastStep,
+		&i.TokenHash,
 		&i.CreatedAt_2,
 		&i.UpdatedAt_2,
 		&i.UserID,
 		&i.ExpiresAt,
 		&i.RevokedAt,
+		&i.FamilyID,
+		&i.ReplacedBy,
 	)
 	return i, err
 }
 
+const rehashUserPassword = `-- name: RehashUserPassword :exec
+UPDATE users
+SET hashed_password = $3
+WHERE id = $1 AND hashed_password = $2
+`
+
+type RehashUserPasswordParams struct {
+	ID      uuid.UUID
+	OldHash string
+	NewHash string
+}
+
+func (q *Queries) RehashUserPassword(ctx context.Context, arg RehashUserPasswordParams) error {
+	_, err := q.db.ExecContext(ctx, rehashUserPassword, arg.ID, arg.OldHash, arg.NewHash)
+	return err
+}
+
+const setEmailVerificationNonce = `-- name: SetEmailVerificationNonce :exec
+UPDATE users
+SET email_verification_nonce = $2
+WHERE id = $1
+`
+
+type SetEmailVerificationNonceParams struct {
+	ID                     uuid.UUID
+	EmailVerificationNonce uuid.NullUUID
+}
+
+func (q *Queries) SetEmailVerificationNonce(ctx context.Context, arg SetEmailVerificationNonceParams) error {
+	_, err := q.db.ExecContext(ctx, setEmailVerificationNonce, arg.ID, arg.EmailVerificationNonce)
+	return err
+}
+
 const updateUserInfo = `-- name: UpdateUserInfo :one
 UPDATE users
-SET email = $1, hashed_password = $2, updated_at = NOW()
-WHERE id = $3
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+SET email = $1, hashed_password = $2, handle = COALESCE($3, handle),
+    -- a new address has to be verified again
+    email_verified = email_verified AND email = $1,
+    updated_at = NOW()
+WHERE id = $4
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, handle, role, email_verified, email_verification_nonce, totp_secret, totp_enabled, totp_last_step
 `
 
 type UpdateUserInfoParams struct {
 	Email          string
 	HashedPassword string
+	Handle         sql.NullString
 	ID             uuid.UUID
 }
 
 func (q *Queries) UpdateUserInfo(ctx context.Context, arg UpdateUserInfoParams) (User, error) {
-	row := q.db.QueryRowContext(ctx, updateUserInfo, arg.Email, arg.HashedPassword, arg.ID)
+	row := q.db.QueryRowContext(ctx, updateUserInfo,
+		arg.Email,
+		arg.HashedPassword,
+		arg.Handle,
+		arg.ID,
+	)
 	var i User
 	err := row.Scan(
 		&i.ID,
@@ -138,15 +266,38 @@ func (q *Queries) UpdateUserInfo(ctx context.Context, arg UpdateUserInfoParams)
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.Handle,
+		&i.Role,
+		&i.EmailVerified,
+		&i.EmailVerificationNonce,
+		&i.TotpSecret,
+		&i.TotpEnabled,
+		&i.TotpLastStep,
 	)
 	return i, err
 }
 
+const updateUserPassword = `-- name: UpdateUserPassword :exec
+UPDATE users
+SET hashed_password = $2, updated_at = NOW()
+WHERE id = $1
+`
+
+type UpdateUserPasswordParams struct {
+	ID             uuid.UUID
+	HashedPassword string
+}
+
+func (q *Queries) UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) error {
+	_, err := q.db.ExecContext(ctx, updateUserPassword, arg.ID, arg.HashedPassword)
+	return err
+}
+
 const upgradeUserTOChirpyRed = `-- name: UpgradeUserTOChirpyRed :one
 UPDATE users
 SET is_chirpy_red = true, updated_at = NOW()
 WHERE id = $1
-RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red
+RETURNING id, created_at, updated_at, email, hashed_password, is_chirpy_red, handle, role, email_verified, email_verification_nonce, totp_secret, totp_enabled, totp_last_step
 `
 
 func (q *Queries) UpgradeUserTOChirpyRed(ctx context.Context, id uuid.UUID) (User, error) {
@@ -159,6 +310,33 @@ func (q *Queries) UpgradeUserTOChirpyRed(ctx context.Context, id uuid.UUID) (Use
 		&i.Email,
 		&i.HashedPassword,
 		&i.IsChirpyRed,
+		&i.Handle,
+		&i.Role,
+		&i.EmailVerified,
+		&i.EmailVerificationNonce,
+		&i.TotpSecret,
+		&i.TotpEnabled,
+		&i.TotpLastStep,
 	)
 	return i, err
 }
+
+const verifyUserEmail = `-- name: VerifyUserEmail :execrows
+UPDATE users
+SET email_verified = true, email_verification_nonce = NULL, updated_at = NOW()
+WHERE id = $1 AND email = $2 AND email_verification_nonce = $3
+`
+
+type VerifyUserEmailParams struct {
+	ID    uuid.UUID
+	Email string
+	Nonce uuid.NullUUID
+}
+
+func (q *Queries) VerifyUserEmail(ctx context.Context, arg VerifyUserEmailParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, verifyUserEmail, arg.ID, arg.Email, arg.Nonce)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
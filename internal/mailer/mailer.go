@@ -0,0 +1,120 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails. SMTPMailer is the real one; LogMailer only writes them down, for local development and tests.
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// format builds the raw email, with the headers every mail server expects.
+func (m Message) format(from string) []byte {
+	builder := strings.Builder{}
+	builder.WriteString("From: " + from + "\r\n")
+	builder.WriteString("To: " + m.To + "\r\n")
+	builder.WriteString("Subject: " + m.Subject + "\r\n")
+	builder.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	builder.WriteString("\r\n")
+	builder.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return []byte(builder.String())
+}
+
+// validate rejects line breaks in the headers, which would let whoever controls them add their own headers.
+func (m Message) validate() error {
+	if m.To == "" {
+		return errors.New("Email has no recipient")
+	}
+	if strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return errors.New("Email recipient and subject can't contain line breaks")
+	}
+	return nil
+}
+
+// SMTPMailer sends through an SMTP server, with STARTTLS when the server offers it.
+// Username and Password can be left empty for servers that don't need authentication.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, message Message) error {
+	if err := message.validate(); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	// smtp.SendMail doesn't take a context, so the request it belongs to can't cancel it
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.From, []string{message.To}, message.format(m.From))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return errors.New("Error while sending email: " + err.Error())
+		}
+		return nil
+	case <-ctx.Done():
+		return errors.New("Error while sending email: " + ctx.Err().Error())
+	}
+}
+
+// LogMailer appends every email to the file at Path, or to the log when Path is empty, instead of sending it.
+type LogMailer struct {
+	Path string
+	From string
+
+	mu sync.Mutex
+}
+
+func (m *LogMailer) Send(ctx context.Context, message Message) error {
+	if err := message.validate(); err != nil {
+		return err
+	}
+
+	if m.Path == "" {
+		log.Printf("Email to %s: %s\n%s", message.To, message.Subject, message.Body)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.New("Error while opening mail log: " + err.Error())
+	}
+	defer file.Close()
+
+	if _, err2 := fmt.Fprintf(file, "%s\r\n\r\n", message.format(m.From)); err2 != nil {
+		return errors.New("Error while writing to mail log: " + err2.Error())
+	}
+	return nil
+}
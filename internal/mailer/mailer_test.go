@@ -0,0 +1,38 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.log")
+	mailer := &LogMailer{Path: path, From: "chirpy@example.com"}
+
+	err := mailer.Send(context.Background(), Message{To: "user@example.com", Subject: "Verify your email", Body: "Open this link:\nhttp://localhost:8080/api/users/verify?token=abc"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, want := range []string{"From: chirpy@example.com\r\n", "To: user@example.com\r\n", "Subject: Verify your email\r\n", "verify?token=abc"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected the mail log to contain %q, got:\n%s", want, data)
+		}
+	}
+}
+
+func TestMessageHeaderInjection(t *testing.T) {
+	mailer := &LogMailer{Path: filepath.Join(t.TempDir(), "mail.log")}
+
+	err := mailer.Send(context.Background(), Message{To: "user@example.com\r\nBcc: someone@example.com", Subject: "Hi"})
+	if err == nil {
+		t.Errorf("Expected a recipient with a line break to be rejected")
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleJWKS publishes the public keys access tokens are verified with, so other services can check Chirpy's tokens on their own.
+func (cfg *apiConfig) handleJWKS(response_writer http.ResponseWriter, req *http.Request) {
+	jsonResBody, err := json.Marshal(cfg.JWTKeys.JWKS())
+	// short enough for verifiers to pick up a new key soon after a rotation
+	response_writer.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSONResponse(response_writer, jsonResBody, err, 200)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+// viewerID returns the authenticated user of a request that went through middlewareIdentify, if any.
+func viewerID(req *http.Request) uuid.NullUUID {
+	user_id, ok := req.Context().Value("user_id").(uuid.UUID)
+	return uuid.NullUUID{UUID: user_id, Valid: ok}
+}
+
+// addLikeStats fills like_count and viewer_liked on every chirp of the slice with a single query.
+func (cfg *apiConfig) addLikeStats(ctx context.Context, chirps []Chirp, viewer_id uuid.NullUUID) error {
+	if len(chirps) == 0 {
+		return nil
+	}
+
+	chirp_ids := []uuid.UUID{}
+	for _, chirp := range chirps {
+		chirp_ids = append(chirp_ids, uuid.MustParse(chirp.ID))
+	}
+
+	stats, err := cfg.DBQueries.GetChirpLikeStats(ctx, database.GetChirpLikeStatsParams{
+		ViewerID: viewer_id,
+		ChirpIds: chirp_ids,
+	})
+	if err != nil {
+		return err
+	}
+
+	stats_by_chirp := map[string]database.GetChirpLikeStatsRow{}
+	for _, stat := range stats {
+		stats_by_chirp[stat.ChirpID.String()] = stat
+	}
+
+	for i := range chirps {
+		stat := stats_by_chirp[chirps[i].ID]
+		chirps[i].LikeCount = stat.LikeCount
+		chirps[i].ViewerLiked = stat.ViewerLiked
+	}
+
+	return nil
+}
+
+func (cfg *apiConfig) handleLikeChirp(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	chirp_uuid, err := uuid.Parse(req.PathValue("chirpID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing chirp id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	chirp, err3 := cfg.DBQueries.GetChirpById(req.Context(), chirp_uuid)
+	if err3 != nil || chirp.DeletedAt.Valid {
+		errorResBody.Error = "No chirp with this id"
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 404)
+		return
+	}
+
+	rows, err5 := cfg.DBQueries.LikeChirp(req.Context(), database.LikeChirpParams{
+		UserID:  user_id,
+		ChirpID: chirp.ID,
+	})
+	if err5 != nil {
+		errorResBody.Error = "Error while liking chirp: " + err5.Error()
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 500)
+		return
+	}
+
+	// liking the same chirp twice doesn't notify its author twice
+	if rows > 0 {
+		cfg.Notifier.Notify(pendingNotification{
+			UserID:  chirp.UserID,
+			Kind:    NOTIFICATION_LIKE,
+			ActorID: uuid.NullUUID{UUID: user_id, Valid: true},
+			ChirpID: uuid.NullUUID{UUID: chirp.ID, Valid: true},
+		})
+	}
+
+	response_writer.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handleUnlikeChirp(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	chirp_uuid, err := uuid.Parse(req.PathValue("chirpID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing chirp id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	rows, err3 := cfg.DBQueries.UnlikeChirp(req.Context(), database.UnlikeChirpParams{
+		UserID:  user_id,
+		ChirpID: chirp_uuid,
+	})
+	if err3 != nil {
+		errorResBody.Error = "Error while unliking chirp: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	if rows == 0 {
+		errorResBody.Error = "You haven't liked this chirp"
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 404)
+		return
+	}
+
+	response_writer.WriteHeader(204)
+}
+
+type likedChirp struct {
+	Chirp
+	LikedAt time.Time `json:"liked_at"`
+}
+
+func (cfg *apiConfig) handleGetUserLikes(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	user_id, err := uuid.Parse(req.PathValue("userID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing user id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	page_params, err3 := parsePageParams(req.URL.Query(), "desc")
+	if err3 != nil {
+		errorResBody.Error = err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 400)
+		return
+	}
+
+	fetch := func(ascending bool, c *cursor, limit int32) ([]likedChirp, error) {
+		cursor_created_at, cursor_id := cursorPosition(c)
+		liked := []likedChirp{}
+		if ascending {
+			rows, err := cfg.DBQueries.ListLikedChirpsAfter(req.Context(), database.ListLikedChirpsAfterParams{
+				UserID:          user_id,
+				CursorCreatedAt: cursor_created_at,
+				CursorID:        cursor_id,
+				PageLimit:       limit,
+			})
+			for _, row := range rows {
+				liked = append(liked, likedChirp{Chirp: newChirpResponse(row.Chirp), LikedAt: row.LikedAt})
+			}
+			return liked, err
+		}
+		rows, err := cfg.DBQueries.ListLikedChirpsBefore(req.Context(), database.ListLikedChirpsBeforeParams{
+			UserID:          user_id,
+			CursorCreatedAt: cursor_created_at,
+			CursorID:        cursor_id,
+			PageLimit:       limit,
+		})
+		for _, row := range rows {
+			liked = append(liked, likedChirp{Chirp: newChirpResponse(row.Chirp), LikedAt: row.LikedAt})
+		}
+		return liked, err
+	}
+	position := func(liked likedChirp) (time.Time, uuid.UUID) {
+		return liked.LikedAt, uuid.MustParse(liked.ID)
+	}
+
+	liked, next_cursor, prev_cursor, err5 := paginate(page_params, fetch, position)
+	if err5 != nil {
+		errorResBody.Error = "Error while fetching liked chirps from database: " + err5.Error()
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 500)
+		return
+	}
+
+	chirps := []Chirp{}
+	for _, chirp := range liked {
+		chirps = append(chirps, chirp.Chirp)
+	}
+	if err7 := cfg.decorateChirps(req.Context(), chirps, viewerID(req)); err7 != nil {
+		errorResBody.Error = "Error while fetching chirp details from database: " + err7.Error()
+		jsonResBody, err8 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err8, 500)
+		return
+	}
+	for i := range liked {
+		liked[i].Chirp = chirps[i]
+	}
+
+	setPaginationLinks(response_writer, req, next_cursor, prev_cursor)
+	jsonResBody, err9 := json.Marshal(liked)
+	writeJSONResponse(response_writer, jsonResBody, err9, 200)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OmarJarbou/Chirpy/internal/auth"
+	"github.com/OmarJarbou/Chirpy/internal/database"
+)
+
+// Failed logins are counted per account and per client. A client gets many more free failures than an account,
+// since a whole office or mobile network can share one address.
+const LOGIN_FREE_FAILURES_PER_ACCOUNT = 5
+const LOGIN_FREE_FAILURES_PER_IP = 50
+
+const LOGIN_LOCKOUT_BASE = 30 * time.Second
+const LOGIN_LOCKOUT_MAX = 15 * time.Minute
+
+// attemptLimit is one login_failures row an attempt counts against, with the free attempts it has before locking.
+type attemptLimit struct {
+	key  string
+	free int
+	base time.Duration
+	max  time.Duration
+}
+
+// loginFailureKeys are the login_failures rows a login counts against. The account is named by the email typed in,
+// so emails without an account get locked too, and lockouts don't tell which emails have one.
+func loginFailureKeys(email string, req *http.Request) (string, string) {
+	return "email:" + strings.ToLower(strings.TrimSpace(email)), "ip:" + clientIP(req)
+}
+
+// startLoginAttempt counts a login against the account and the client before the password is checked, and says how long
+// it has to wait when either is locked. Counting first is what keeps parallel guesses from all getting in before the first
+// failure is recorded: the attempt that uses up the free failures of a key locks it right away, so the guesses sent along
+// with it are turned away. The keys it locked are returned for finishLoginAttempt.
+func (cfg *apiConfig) startLoginAttempt(ctx context.Context, accountKey string, ipKey string) (time.Duration, []string, error) {
+	return cfg.startAttempt(ctx,
+		attemptLimit{accountKey, LOGIN_FREE_FAILURES_PER_ACCOUNT, LOGIN_LOCKOUT_BASE, LOGIN_LOCKOUT_MAX},
+		attemptLimit{ipKey, LOGIN_FREE_FAILURES_PER_IP, LOGIN_LOCKOUT_BASE, LOGIN_LOCKOUT_MAX},
+	)
+}
+
+// startAttempt counts an attempt against every limit at once, so that one turned away by any of them counts against none.
+func (cfg *apiConfig) startAttempt(ctx context.Context, limits ...attemptLimit) (time.Duration, []string, error) {
+	tx, err := cfg.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, errors.New("Error while starting transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	queries := cfg.DBQueries.WithTx(tx)
+
+	locked_keys := []string{}
+	for _, limit := range limits {
+		attempt, err2 := queries.CountLoginAttempt(ctx, limit.key)
+		if err2 != nil {
+			return 0, nil, errors.New("Error while counting login attempt: " + err2.Error())
+		}
+		// returning rolls the transaction back, so an attempt that is turned away counts against no key
+		if attempt.LockedUntil.Valid && time.Now().Before(attempt.LockedUntil.Time) {
+			return time.Until(attempt.LockedUntil.Time), nil, nil
+		}
+
+		backoff := auth.LoginBackoff(int(attempt.Failures), limit.free, limit.base, limit.max)
+		if backoff == 0 {
+			continue
+		}
+		err3 := queries.LockLogin(ctx, database.LockLoginParams{
+			Key:         limit.key,
+			LockedUntil: sql.NullTime{Time: time.Now().Add(backoff), Valid: true},
+		})
+		if err3 != nil {
+			return 0, nil, errors.New("Error while locking login: " + err3.Error())
+		}
+		locked_keys = append(locked_keys, limit.key)
+	}
+
+	if err4 := tx.Commit(); err4 != nil {
+		return 0, nil, errors.New("Error while committing login attempt: " + err4.Error())
+	}
+	return 0, locked_keys, nil
+}
+
+// finishLoginAttempt takes a login whose password was right off the counts. Only the account starts over: the client just
+// gets its attempt back, or one valid account would wipe its count for any number of guesses.
+func (cfg *apiConfig) finishLoginAttempt(ctx context.Context, accountKey string, ipKey string, lockedKeys []string) error {
+	if err := cfg.DBQueries.ClearLoginFailures(ctx, accountKey); err != nil {
+		return errors.New("Error while clearing failed logins: " + err.Error())
+	}
+
+	err2 := cfg.DBQueries.UncountLoginAttempt(ctx, database.UncountLoginAttemptParams{
+		Unlock: slices.Contains(lockedKeys, ipKey),
+		Key:    ipKey,
+	})
+	if err2 != nil {
+		return errors.New("Error while taking back login attempt: " + err2.Error())
+	}
+	return nil
+}
+
+func writeLoginLockedResponse(response_writer http.ResponseWriter, retryAfter time.Duration) {
+	writeTooManyAttemptsResponse(response_writer, "Too many failed logins", retryAfter)
+}
+
+func writeTooManyAttemptsResponse(response_writer http.ResponseWriter, reason string, retryAfter time.Duration) {
+	errorResBody := errorResponseBody{}
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	response_writer.Header().Set("Retry-After", strconv.Itoa(seconds))
+	errorResBody.Error = fmt.Sprintf("%s, try again in %d seconds", reason, seconds)
+	jsonResBody, err := json.Marshal(errorResBody)
+	writeJSONResponse(response_writer, jsonResBody, err, 429)
+}
@@ -5,15 +5,35 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync/atomic"
 
+	"github.com/OmarJarbou/Chirpy/internal/auth"
 	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/OmarJarbou/Chirpy/internal/mailer"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
 const PORT string = "8080"
 
+// MIN_SECRET_KEY_LENGTH is the shortest key accepted to hash or sign tokens with.
+const MIN_SECRET_KEY_LENGTH = 32
+
+// secretKey reads the key of the env var name, or CHIRPY_SECRET_KEY when it isn't set.
+// An empty or short key would make stored token hashes easy to forge, so the server refuses to start with one.
+func secretKey(name string) string {
+	key := os.Getenv(name)
+	if key == "" {
+		key = os.Getenv("CHIRPY_SECRET_KEY")
+	}
+	if len(key) < MIN_SECRET_KEY_LENGTH {
+		log.Fatalf("%s (or CHIRPY_SECRET_KEY) must be set to a key of at least %d characters", name, MIN_SECRET_KEY_LENGTH)
+	}
+	return key
+}
+
 func main() {
 	godotenv.Load()
 
@@ -26,6 +46,99 @@ func main() {
 
 	dbQueries := database.New(db)
 
+	// refresh tokens are hashed with their own key when one is set, so the JWT secret can be rotated without logging everybody out
+	refresh_token_key := secretKey("REFRESH_TOKEN_KEY")
+
+	// verification links are signed with their own key when one is set
+	email_token_key := secretKey("EMAIL_TOKEN_KEY")
+
+	public_url := os.Getenv("PUBLIC_URL")
+	if public_url == "" {
+		public_url = "http://localhost:" + PORT
+	}
+
+	// emails go out through SMTP when MAILER=smtp; otherwise they're only written to MAIL_LOG_FILE, or to the log
+	mail_from := os.Getenv("MAIL_FROM")
+	if mail_from == "" {
+		mail_from = "no-reply@localhost"
+	}
+	var api_mailer mailer.Mailer
+	if os.Getenv("MAILER") == "smtp" {
+		smtp_port := os.Getenv("SMTP_PORT")
+		if smtp_port == "" {
+			smtp_port = "587"
+		}
+		api_mailer = &mailer.SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     smtp_port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     mail_from,
+		}
+	} else {
+		api_mailer = &mailer.LogMailer{Path: os.Getenv("MAIL_LOG_FILE"), From: mail_from}
+	}
+
+	// new password hashes use argon2id with these parameters; existing hashes are upgraded as their users log in
+	password_params := auth.DefaultArgon2idParams
+	for name, field := range map[string]*uint32{
+		"PASSWORD_HASH_MEMORY_KIB": &password_params.Memory,
+		"PASSWORD_HASH_ITERATIONS": &password_params.Iterations,
+	} {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				log.Fatal("Error while reading "+name+": ", err)
+			}
+			*field = uint32(parsed)
+		}
+	}
+	if value := os.Getenv("PASSWORD_HASH_PARALLELISM"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			log.Fatal("Error while reading PASSWORD_HASH_PARALLELISM: ", err)
+		}
+		password_params.Parallelism = uint8(parsed)
+	}
+	if err := auth.SetPasswordHashParams(password_params); err != nil {
+		log.Fatal("Error while setting password hash parameters: ", err)
+	}
+
+	// new passwords must follow this policy; existing ones aren't checked again
+	password_policy := auth.DefaultPasswordPolicy
+	if value := os.Getenv("PASSWORD_MIN_LENGTH"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatal("Error while reading PASSWORD_MIN_LENGTH: ", err)
+		}
+		password_policy.MinLength = parsed
+	}
+	password_classes, err := auth.ParsePasswordClasses(os.Getenv("PASSWORD_REQUIRED_CLASSES"))
+	if err != nil {
+		log.Fatal("Error while reading PASSWORD_REQUIRED_CLASSES: ", err)
+	}
+	password_policy.RequiredClasses = password_classes
+	password_policy.ForbidEmail = os.Getenv("PASSWORD_ALLOW_EMAIL") != "true"
+	password_policy.ForbidBreached = os.Getenv("PASSWORD_ALLOW_BREACHED") != "true"
+
+	// access tokens are signed with the keys of JWT_KEYS_DIR. A temporary key would log everybody out on restart,
+	// and each instance behind a load balancer would refuse the others' tokens, so it's only allowed on PLATFORM=dev
+	var jwt_keys *auth.KeySet
+	var err2 error
+	if keys_dir := os.Getenv("JWT_KEYS_DIR"); keys_dir != "" {
+		jwt_keys, err2 = auth.LoadKeySet(keys_dir, os.Getenv("JWT_SIGNING_KEY_ID"))
+	} else if os.Getenv("PLATFORM") == PLATFORM_DEV {
+		log.Print("JWT_KEYS_DIR isn't set, signing access tokens with a temporary key")
+		jwt_keys, err2 = auth.GenerateKeySet()
+	} else {
+		log.Fatal("JWT_KEYS_DIR must be set to the folder of the access token signing keys (only PLATFORM=dev may do without)")
+	}
+	if err2 != nil {
+		log.Fatal("Error while loading JWT signing keys: ", err2)
+		os.Exit(1)
+	}
+	ws_hub := newWSHub()
+
 	serve_mux := http.NewServeMux()
 
 	server := http.Server{
@@ -34,10 +147,21 @@ func main() {
 	}
 
 	api_config := apiConfig{
-		fileserverHits:  atomic.Int32{},
-		DBQueries:       dbQueries,
-		ChirpySecretKey: os.Getenv("CHIRPY_SECRET_KEY"),
-		PolkaKey:        os.Getenv("POLKA_KEY"),
+		fileserverHits:       atomic.Int32{},
+		DB:                   db,
+		DBQueries:            dbQueries,
+		JWTKeys:              jwt_keys,
+		RefreshTokenKey:      refresh_token_key,
+		EmailTokenKey:        email_token_key,
+		PolkaKey:             os.Getenv("POLKA_KEY"),
+		Platform:             os.Getenv("PLATFORM"),
+		PublicURL:            strings.TrimSuffix(public_url, "/"),
+		Mailer:               api_mailer,
+		RequireVerifiedEmail: os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true",
+		PasswordPolicy:       password_policy,
+		Notifier:             newNotifier(dbQueries, ws_hub.DeliverNotification),
+		ChirpStream:          newChirpBroadcaster(),
+		WSHub:                ws_hub,
 	}
 
 	// option 1:
@@ -64,24 +188,68 @@ func main() {
 	// Since there isn't one, it would likely return a 404 Not Found error.
 
 	serve_mux.HandleFunc("GET /api/healthz", readinessHandler)
-
-	serve_mux.HandleFunc("GET /admin/metrics", api_config.numberOfRequestsEncountered)
-	serve_mux.HandleFunc("POST /admin/reset", api_config.resetFileServerHits)
-	serve_mux.Handle("POST /api/users", middlewareValidatePassword(http.HandlerFunc(api_config.handleCreateUser)))
-	serve_mux.Handle("PUT /api/users", api_config.middlewareAuthorize(middlewareValidatePassword(http.HandlerFunc(api_config.handleUpdateUser))))
+	serve_mux.HandleFunc("GET /.well-known/jwks.json", api_config.handleJWKS)
+
+	serve_mux.Handle("GET /admin/metrics", api_config.middlewareAuthorize(api_config.middlewareRequireRole(ROLE_ADMIN, http.HandlerFunc(api_config.numberOfRequestsEncountered))))
+	serve_mux.Handle("POST /admin/reset", api_config.middlewareAuthorize(api_config.middlewareRequireRole(ROLE_ADMIN, http.HandlerFunc(api_config.resetFileServerHits))))
+	serve_mux.Handle("POST /admin/tags/reindex", api_config.middlewareAuthorize(api_config.middlewareRequireRole(ROLE_ADMIN, http.HandlerFunc(api_config.handleReindexTags))))
+	serve_mux.Handle("POST /api/users", api_config.middlewareValidatePassword(http.HandlerFunc(api_config.handleCreateUser)))
+	// no scope: changing the email and password is a takeover of the account, which a leaked personal access token mustn't allow
+	serve_mux.Handle("PUT /api/users", api_config.middlewareAuthorize(api_config.middlewareValidatePassword(http.HandlerFunc(api_config.handleUpdateUser))))
+	serve_mux.HandleFunc("GET /api/users/verify", api_config.handleVerifyEmail)
+	serve_mux.Handle("POST /api/users/verify/resend", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleResendEmailVerification)))
+	serve_mux.Handle("POST /api/users/2fa/enroll", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleEnrollTwoFactor)))
+	serve_mux.Handle("POST /api/users/2fa/confirm", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleConfirmTwoFactor)))
+	serve_mux.Handle("POST /api/users/2fa/disable", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleDisableTwoFactor)))
+	serve_mux.HandleFunc("GET /api/users/{handle}", api_config.handleGetUserProfile)
+	serve_mux.Handle("POST /api/users/{userID}/follow", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleFollowUser), SCOPE_PROFILE_WRITE))
+	serve_mux.Handle("DELETE /api/users/{userID}/follow", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleUnfollowUser), SCOPE_PROFILE_WRITE))
+	serve_mux.HandleFunc("GET /api/users/{userID}/followers", api_config.handleGetFollowers)
+	serve_mux.HandleFunc("GET /api/users/{userID}/following", api_config.handleGetFollowing)
+	serve_mux.HandleFunc("GET /api/users/{userID}/follow-counts", api_config.handleGetFollowCounts)
+	serve_mux.Handle("GET /api/users/{userID}/likes", api_config.middlewareIdentify(http.HandlerFunc(api_config.handleGetUserLikes), SCOPE_CHIRPS_READ))
+	serve_mux.Handle("GET /api/timeline", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleGetTimeline), SCOPE_CHIRPS_READ))
 	serve_mux.HandleFunc("POST /api/login", api_config.handleLogin)
+	serve_mux.HandleFunc("POST /api/login/2fa", api_config.handleLoginTwoFactor)
 	serve_mux.HandleFunc("POST /api/refresh", api_config.handleRefreshToken)
 	serve_mux.HandleFunc("POST /api/revoke", api_config.handleRevokeToken)
-	serve_mux.Handle("POST /api/chirps", api_config.middlewareAuthorize(middlewareValidateChirp(http.HandlerFunc(api_config.handleCreateChirp))))
-	serve_mux.Handle("DELETE /api/chirps/{chirpID}", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleDeleteChirp)))
-	serve_mux.HandleFunc("GET /api/chirps", api_config.handleGetAllChirps)
-	serve_mux.HandleFunc("GET /api/chirps/{chirpID}", api_config.handleGetChirpByID)
+	serve_mux.HandleFunc("POST /api/password-reset/request", api_config.handleRequestPasswordReset)
+	serve_mux.HandleFunc("POST /api/password-reset/confirm", api_config.handleConfirmPasswordReset)
+	serve_mux.Handle("GET /api/sessions", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleGetSessions)))
+	serve_mux.Handle("DELETE /api/sessions", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleRevokeAllSessions)))
+	serve_mux.Handle("DELETE /api/sessions/{sessionID}", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleRevokeSession)))
+	serve_mux.Handle("POST /api/tokens", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleCreatePersonalAccessToken)))
+	serve_mux.Handle("GET /api/tokens", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleGetPersonalAccessTokens)))
+	serve_mux.Handle("DELETE /api/tokens/{tokenID}", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleRevokePersonalAccessToken)))
+	serve_mux.Handle("POST /api/chirps", api_config.middlewareAuthorize(api_config.middlewareRequireVerifiedEmail(middlewareValidateChirp(http.HandlerFunc(api_config.handleCreateChirp))), SCOPE_CHIRPS_WRITE))
+	serve_mux.Handle("PUT /api/chirps/{chirpID}", api_config.middlewareAuthorize(middlewareValidateChirp(http.HandlerFunc(api_config.handleUpdateChirp)), SCOPE_CHIRPS_WRITE))
+	serve_mux.Handle("PATCH /api/chirps/{chirpID}", api_config.middlewareAuthorize(middlewareValidateChirp(http.HandlerFunc(api_config.handleUpdateChirp)), SCOPE_CHIRPS_WRITE))
+	serve_mux.Handle("DELETE /api/chirps/{chirpID}", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleDeleteChirp), SCOPE_CHIRPS_WRITE))
+	serve_mux.Handle("GET /api/chirps", api_config.middlewareIdentify(http.HandlerFunc(api_config.handleGetAllChirps), SCOPE_CHIRPS_READ))
+	serve_mux.HandleFunc("GET /api/chirps/stream", api_config.handleChirpStream)
+	serve_mux.Handle("GET /api/chirps/search", api_config.middlewareIdentify(http.HandlerFunc(api_config.handleSearchChirps), SCOPE_CHIRPS_READ))
+	serve_mux.Handle("GET /api/chirps/{chirpID}", api_config.middlewareIdentify(http.HandlerFunc(api_config.handleGetChirpByID), SCOPE_CHIRPS_READ))
+	serve_mux.HandleFunc("GET /api/chirps/{chirpID}/revisions", api_config.handleGetChirpRevisions)
+	serve_mux.Handle("GET /api/chirps/{chirpID}/thread", api_config.middlewareIdentify(http.HandlerFunc(api_config.handleGetChirpThread), SCOPE_CHIRPS_READ))
+	serve_mux.Handle("POST /api/chirps/{chirpID}/likes", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleLikeChirp), SCOPE_CHIRPS_WRITE))
+	serve_mux.Handle("DELETE /api/chirps/{chirpID}/likes", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleUnlikeChirp), SCOPE_CHIRPS_WRITE))
+	serve_mux.Handle("POST /api/chirps/{chirpID}/rechirp", api_config.middlewareAuthorize(api_config.middlewareRequireVerifiedEmail(http.HandlerFunc(api_config.handleRechirp)), SCOPE_CHIRPS_WRITE))
+	serve_mux.Handle("DELETE /api/chirps/{chirpID}/rechirp", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleUndoRechirp), SCOPE_CHIRPS_WRITE))
+	serve_mux.HandleFunc("GET /api/tags/trending", api_config.handleGetTrendingTags)
+	serve_mux.Handle("GET /api/tags/{tag}/chirps", api_config.middlewareIdentify(http.HandlerFunc(api_config.handleGetTagChirps), SCOPE_CHIRPS_READ))
+
+	serve_mux.Handle("GET /api/notifications", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleGetNotifications)))
+	serve_mux.Handle("GET /api/notifications/unread-count", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleGetUnreadNotificationsCount)))
+	serve_mux.Handle("POST /api/notifications/read-all", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleMarkAllNotificationsRead)))
+	serve_mux.Handle("POST /api/notifications/{notificationID}/read", api_config.middlewareAuthorize(http.HandlerFunc(api_config.handleMarkNotificationRead)))
+
+	serve_mux.HandleFunc("GET /api/ws", api_config.handleWebSocket)
 
 	serve_mux.HandleFunc("POST /api/polka/webhooks", api_config.webhookHandler)
 
-	err2 := server.ListenAndServe()
-	if err2 != nil {
-		log.Fatal("Error while listening on port '"+PORT+"':", err2)
+	err3 := server.ListenAndServe()
+	if err3 != nil {
+		log.Fatal("Error while listening on port '"+PORT+"':", err3)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+const MIN_HANDLE_LENGTH = 3
+const MAX_HANDLE_LENGTH = 20
+
+var handleRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// reservedHandles are path segments of /api/users/... that would hide the profile of a user with that handle
+var reservedHandles = map[string]bool{
+	"verify": true,
+}
+
+// a mention starts at the beginning of the chirp or after anything that can't be part of a handle,
+// so email addresses like "me@example.com" don't count
+var mentionRegexp = regexp.MustCompile(`(?:^|[^A-Za-z0-9_])@([A-Za-z0-9_]+)`)
+
+// normalizeHandle lowercases a handle and drops its leading @, returning false when what's left isn't a valid handle.
+// Handles are 3 to 20 letters, digits or underscores.
+func normalizeHandle(handle string) (string, bool) {
+	handle = strings.ToLower(strings.TrimPrefix(handle, "@"))
+	if len(handle) < MIN_HANDLE_LENGTH || len(handle) > MAX_HANDLE_LENGTH || !handleRegexp.MatchString(handle) {
+		return "", false
+	}
+	return handle, true
+}
+
+// extractMentions returns the distinct normalized handles mentioned in a chirp body, in the order they first appear.
+func extractMentions(body string) []string {
+	handles := []string{}
+	seen := map[string]bool{}
+
+	for _, match := range mentionRegexp.FindAllStringSubmatch(body, -1) {
+		handle, ok := normalizeHandle(match[1])
+		if !ok || seen[handle] {
+			continue
+		}
+		seen[handle] = true
+		handles = append(handles, handle)
+	}
+
+	return handles
+}
+
+// saveChirpMentions records the users a new chirp mentions and returns their ids.
+// Handles that don't belong to anybody are ignored.
+func saveChirpMentions(ctx context.Context, queries *database.Queries, chirp database.Chirp) ([]uuid.UUID, error) {
+	handles := extractMentions(chirp.Body)
+	if len(handles) == 0 {
+		return nil, nil
+	}
+
+	return queries.AddChirpMentions(ctx, database.AddChirpMentionsParams{
+		ChirpID:   chirp.ID,
+		CreatedAt: chirp.CreatedAt,
+		Handles:   handles,
+	})
+}
@@ -3,12 +3,24 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"regexp"
 
 	"github.com/OmarJarbou/Chirpy/internal/auth"
 )
 
+const ROLE_USER = "user"
+const ROLE_MODERATOR = "moderator"
+const ROLE_ADMIN = "admin"
+
+// every role can do what the roles below it can
+var roleRanks = map[string]int{
+	ROLE_USER:      1,
+	ROLE_MODERATOR: 2,
+	ROLE_ADMIN:     3,
+}
+
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(response_writer http.ResponseWriter, req *http.Request) {
 		cfg.fileserverHits.Add(1)
@@ -50,13 +62,15 @@ func middlewareValidateChirp(next http.Handler) http.Handler {
 		}
 
 		ctx := context.WithValue(req.Context(), "filtered_chirp", filtered_chirp)
+		ctx = context.WithValue(ctx, "in_reply_to", reqBody.InReplyTo)
+		ctx = context.WithValue(ctx, "quote_of", reqBody.QuoteOf)
 
 		// if chirp is valid
 		next.ServeHTTP(response_writer, req.WithContext(ctx))
 	})
 }
 
-func middlewareValidatePassword(next http.Handler) http.Handler {
+func (cfg *apiConfig) middlewareValidatePassword(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(response_writer http.ResponseWriter, req *http.Request) {
 		reqBody := userRequestBody{}
 		errorResBody := errorResponseBody{}
@@ -67,49 +81,142 @@ func middlewareValidatePassword(next http.Handler) http.Handler {
 			return
 		}
 
-		// if len(reqBody.Password) < 8 {
-		// 	errorResBody.Error = "Password must be 8 characters length or more."
-		// 	jsonResBody, err3 := json.Marshal(errorResBody)
-		// 	writeJSONResponse(response_writer, jsonResBody, err3, 400)
-		// 	return
-		// }
-
-		// re := regexp.MustCompile(`^(?=.*[a-z])(?=.*[A-Z])(?=.*\d)(?=.*[!@#$%^&*()_\-+=\[\]{}|;:'",.<>?/]).{8,}$`)
-		// if !re.MatchString(reqBody.Password) {
-		// 	errorResBody.Error = "Password must have At least 1 uppercase letter, 1 lowercase letter, 1 number, 1 special character (!@#$%^&*()-_=+[]{}|;:'\",.<>?/)"
-		// 	jsonResBody, err4 := json.Marshal(errorResBody)
-		// 	writeJSONResponse(response_writer, jsonResBody, err4, 400)
-		// 	return
-		// }
+		if !cfg.enforcePasswordPolicy(response_writer, reqBody.Password, reqBody.Email) {
+			return
+		}
+
+		handle := ""
+		if reqBody.Handle != "" {
+			normalized_handle, ok := normalizeHandle(reqBody.Handle)
+			if !ok {
+				errorResBody.Error = "Handle must be 3 to 20 letters, digits or underscores"
+				jsonResBody, err3 := json.Marshal(errorResBody)
+				writeJSONResponse(response_writer, jsonResBody, err3, 400)
+				return
+			}
+			if reservedHandles[normalized_handle] {
+				errorResBody.Error = "This handle is reserved"
+				jsonResBody, err4 := json.Marshal(errorResBody)
+				writeJSONResponse(response_writer, jsonResBody, err4, 400)
+				return
+			}
+			handle = normalized_handle
+		}
 
 		ctx := context.WithValue(req.Context(), "password", reqBody.Password)
 		ctx = context.WithValue(ctx, "email", reqBody.Email)
+		ctx = context.WithValue(ctx, "handle", handle)
 
 		next.ServeHTTP(response_writer, req.WithContext(ctx))
 	})
 }
 
-func (cfg *apiConfig) middlewareAuthorize(next http.Handler) http.Handler {
+// middlewareAuthorize lets through requests carrying a valid access token.
+// A personal access token is accepted too, but only on routes that list scopes and only if it was granted all of them.
+func (cfg *apiConfig) middlewareAuthorize(next http.Handler, scopes ...string) http.Handler {
 	return http.HandlerFunc(func(response_writer http.ResponseWriter, req *http.Request) {
 		errorResBody := errorResponseBody{}
 
 		token_string, err := auth.GetBearerToken(req.Header)
 		if err != nil {
+			response_writer.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
 			errorResBody.Error = err.Error()
 			jsonResBody, err2 := json.Marshal(errorResBody)
 			writeJSONResponse(response_writer, jsonResBody, err2, 401)
 			return
 		}
 
-		user_id, err3 := auth.ValidateJWT(token_string, cfg.ChirpySecretKey)
+		if auth.IsPersonalAccessToken(token_string) {
+			cfg.authorizePersonalAccessToken(response_writer, req, token_string, scopes, next)
+			return
+		}
+
+		claims, err3 := cfg.JWTKeys.ValidateJWTClaims(token_string)
 		if err3 != nil {
+			// RFC 6750 challenge, so clients can tell an expired token (refresh it) from one that will never work
+			challenge := `Bearer realm="chirpy", error="invalid_token"`
+			var token_error *auth.TokenError
+			if errors.As(err3, &token_error) {
+				challenge += `, error_description="` + token_error.Kind.Error() + `"`
+			}
+			response_writer.Header().Set("WWW-Authenticate", challenge)
 			errorResBody.Error = err3.Error()
 			jsonResBody, err4 := json.Marshal(errorResBody)
 			writeJSONResponse(response_writer, jsonResBody, err4, 401)
 			return
 		}
 
-		ctx := context.WithValue(req.Context(), "user_id", user_id)
+		ctx := context.WithValue(req.Context(), "user_id", claims.UserID)
+		ctx = context.WithValue(ctx, "role", claims.Role)
+		next.ServeHTTP(response_writer, req.WithContext(ctx))
+	})
+}
+
+// middlewareRequireRole goes after middlewareAuthorize and lets through users whose role is at least the given one.
+// The role comes from the access token, so a role change applies once the user's current token expires.
+func (cfg *apiConfig) middlewareRequireRole(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response_writer http.ResponseWriter, req *http.Request) {
+		errorResBody := errorResponseBody{}
+
+		user_role, _ := req.Context().Value("role").(string)
+		if roleRanks[user_role] < roleRanks[role] {
+			errorResBody.Error = "This requires the " + role + " role"
+			jsonResBody, err := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err, 403)
+			return
+		}
+
+		next.ServeHTTP(response_writer, req)
+	})
+}
+
+// middlewareIdentify is the optional version of middlewareAuthorize, for public routes whose response depends on who is asking.
+// A request without a usable token (missing, expired, revoked, or a personal access token without the scopes) is served anonymously,
+// so a client holding a stale token still gets the public data.
+func (cfg *apiConfig) middlewareIdentify(next http.Handler, scopes ...string) http.Handler {
+	return http.HandlerFunc(func(response_writer http.ResponseWriter, req *http.Request) {
+		errorResBody := errorResponseBody{}
+
+		token_string, err := auth.GetBearerToken(req.Header)
+		if err != nil {
+			next.ServeHTTP(response_writer, req)
+			return
+		}
+
+		if !auth.IsPersonalAccessToken(token_string) {
+			claims, err2 := cfg.JWTKeys.ValidateJWTClaims(token_string)
+			if err2 != nil {
+				next.ServeHTTP(response_writer, req)
+				return
+			}
+			ctx := context.WithValue(req.Context(), "user_id", claims.UserID)
+			ctx = context.WithValue(ctx, "role", claims.Role)
+			next.ServeHTTP(response_writer, req.WithContext(ctx))
+			return
+		}
+
+		row, invalid_reason, err3 := cfg.lookupPersonalAccessToken(req.Context(), token_string)
+		if err3 != nil {
+			errorResBody.Error = err3.Error()
+			jsonResBody, err4 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err4, 500)
+			return
+		}
+		token := row.PersonalAccessToken
+		if invalid_reason != "" || len(scopes) == 0 || !hasAllScopes(token.Scopes, scopes) {
+			next.ServeHTTP(response_writer, req)
+			return
+		}
+
+		if err5 := cfg.DBQueries.TouchPersonalAccessToken(req.Context(), token.ID); err5 != nil {
+			errorResBody.Error = "Error while updating personal access token: " + err5.Error()
+			jsonResBody, err6 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err6, 500)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), "user_id", token.UserID)
+		ctx = context.WithValue(ctx, "role", row.UserRole)
 		next.ServeHTTP(response_writer, req.WithContext(ctx))
 	})
 }
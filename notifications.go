@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+const NOTIFICATION_LIKE = "like"
+const NOTIFICATION_REPLY = "reply"
+const NOTIFICATION_FOLLOW = "follow"
+const NOTIFICATION_MENTION = "mention"
+const NOTIFICATION_CHIRPY_RED = "chirpy_red"
+
+const NOTIFICATION_QUEUE_SIZE = 1024
+const NOTIFICATION_INSERT_TIMEOUT = 5 * time.Second
+
+type pendingNotification struct {
+	UserID  uuid.UUID
+	Kind    string
+	ActorID uuid.NullUUID
+	ChirpID uuid.NullUUID
+}
+
+// notifier saves notifications from a background goroutine, so handlers only pay for a channel send.
+// Once saved, a notification is handed to deliver so it can be pushed to the user's open connections.
+type notifier struct {
+	queries *database.Queries
+	queue   chan pendingNotification
+	deliver func(notification database.Notification)
+}
+
+type notificationResponse struct {
+	ID          string     `json:"id"`
+	Kind        string     `json:"kind"`
+	ActorID     string     `json:"actor_id,omitempty"`
+	ActorHandle string     `json:"actor_handle,omitempty"`
+	ChirpID     string     `json:"chirp_id,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ReadAt      *time.Time `json:"read_at"`
+
+	id uuid.UUID
+}
+
+type unreadNotificationsResponseBody struct {
+	Unread int64 `json:"unread"`
+}
+
+func newNotifier(queries *database.Queries, deliver func(notification database.Notification)) *notifier {
+	n := &notifier{
+		queries: queries,
+		queue:   make(chan pendingNotification, NOTIFICATION_QUEUE_SIZE),
+		deliver: deliver,
+	}
+	go n.run()
+	return n
+}
+
+func (n *notifier) run() {
+	for pending := range n.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), NOTIFICATION_INSERT_TIMEOUT)
+		notification, err := n.queries.CreateNotification(ctx, database.CreateNotificationParams{
+			UserID:  pending.UserID,
+			Kind:    pending.Kind,
+			ActorID: pending.ActorID,
+			ChirpID: pending.ChirpID,
+		})
+		cancel()
+		if err != nil {
+			log.Printf("Error while saving %s notification for user %s: %v", pending.Kind, pending.UserID, err)
+			continue
+		}
+		if n.deliver != nil {
+			n.deliver(notification)
+		}
+	}
+}
+
+// Notify queues a notification without waiting for it to be saved.
+// Users are never notified about their own actions, and when the queue is full the notification is dropped rather than blocking the request.
+func (n *notifier) Notify(pending pendingNotification) {
+	if pending.ActorID.Valid && pending.ActorID.UUID == pending.UserID {
+		return
+	}
+
+	select {
+	case n.queue <- pending:
+	default:
+		log.Printf("Notification queue is full, dropping %s notification for user %s", pending.Kind, pending.UserID)
+	}
+}
+
+func newNotificationResponse(notification database.Notification, actor_handle string) notificationResponse {
+	response := notificationResponse{
+		ID:          notification.ID.String(),
+		Kind:        notification.Kind,
+		ActorHandle: actor_handle,
+		CreatedAt:   notification.CreatedAt,
+		id:          notification.ID,
+	}
+	if notification.ActorID.Valid {
+		response.ActorID = notification.ActorID.UUID.String()
+	}
+	if notification.ChirpID.Valid {
+		response.ChirpID = notification.ChirpID.UUID.String()
+	}
+	if notification.ReadAt.Valid {
+		response.ReadAt = &notification.ReadAt.Time
+	}
+	return response
+}
+
+func (cfg *apiConfig) handleGetNotifications(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	page_params, err := parsePageParams(req.URL.Query(), "desc")
+	if err != nil {
+		errorResBody.Error = err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	unread_only := req.URL.Query().Get("unread") == "true"
+
+	fetch := func(ascending bool, c *cursor, limit int32) ([]notificationResponse, error) {
+		cursor_created_at, cursor_id := cursorPosition(c)
+		notifications := []notificationResponse{}
+		if ascending {
+			rows, err := cfg.DBQueries.ListNotificationsAfter(req.Context(), database.ListNotificationsAfterParams{
+				UserID:          user_id,
+				UnreadOnly:      unread_only,
+				CursorCreatedAt: cursor_created_at,
+				CursorID:        cursor_id,
+				PageLimit:       limit,
+			})
+			for _, row := range rows {
+				notifications = append(notifications, newNotificationResponse(row.Notification, row.ActorHandle.String))
+			}
+			return notifications, err
+		}
+		rows, err := cfg.DBQueries.ListNotificationsBefore(req.Context(), database.ListNotificationsBeforeParams{
+			UserID:          user_id,
+			UnreadOnly:      unread_only,
+			CursorCreatedAt: cursor_created_at,
+			CursorID:        cursor_id,
+			PageLimit:       limit,
+		})
+		for _, row := range rows {
+			notifications = append(notifications, newNotificationResponse(row.Notification, row.ActorHandle.String))
+		}
+		return notifications, err
+	}
+	position := func(notification notificationResponse) (time.Time, uuid.UUID) {
+		return notification.CreatedAt, notification.id
+	}
+
+	notifications, next_cursor, prev_cursor, err3 := paginate(page_params, fetch, position)
+	if err3 != nil {
+		errorResBody.Error = "Error while fetching notifications from database: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	setPaginationLinks(response_writer, req, next_cursor, prev_cursor)
+	jsonResBody, err5 := json.Marshal(notifications)
+	writeJSONResponse(response_writer, jsonResBody, err5, 200)
+}
+
+func (cfg *apiConfig) handleGetUnreadNotificationsCount(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	unread, err := cfg.DBQueries.CountUnreadNotifications(req.Context(), user_id)
+	if err != nil {
+		errorResBody.Error = "Error while counting unread notifications: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 500)
+		return
+	}
+
+	successResBody := unreadNotificationsResponseBody{
+		Unread: unread,
+	}
+	jsonResBody, err3 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err3, 200)
+}
+
+func (cfg *apiConfig) handleMarkNotificationRead(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	notification_id, err := uuid.Parse(req.PathValue("notificationID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing notification id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	rows, err3 := cfg.DBQueries.MarkNotificationRead(req.Context(), database.MarkNotificationReadParams{
+		ID:     notification_id,
+		UserID: user_id,
+	})
+	if err3 != nil {
+		errorResBody.Error = "Error while marking notification as read: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	if rows == 0 {
+		errorResBody.Error = "No notification with this id"
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 404)
+		return
+	}
+
+	response_writer.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handleMarkAllNotificationsRead(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	err := cfg.DBQueries.MarkAllNotificationsRead(req.Context(), user_id)
+	if err != nil {
+		errorResBody.Error = "Error while marking notifications as read: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 500)
+		return
+	}
+
+	response_writer.WriteHeader(204)
+}
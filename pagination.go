@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const DEFAULT_PAGE_LIMIT = 50
+const MAX_PAGE_LIMIT = 100
+
+// cursor points at a single row in a (created_at, id) ordered listing, or a (rank, created_at, id) one for search.
+// Direction tells whether the page starts after that row ("next") or ends before it ("prev").
+type cursor struct {
+	Rank      float32   `json:"r,omitempty"`
+	CreatedAt time.Time `json:"t"`
+	ID        uuid.UUID `json:"id"`
+	Direction string    `json:"d"`
+}
+
+type pageParams struct {
+	Limit  int
+	Sort   string
+	Cursor *cursor
+}
+
+func encodeCursor(c cursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(cursor_string string) (*cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor_string)
+	if err != nil {
+		return nil, errors.New("Invalid cursor: " + err.Error())
+	}
+
+	c := cursor{}
+	if err2 := json.Unmarshal(raw, &c); err2 != nil {
+		return nil, errors.New("Invalid cursor: " + err2.Error())
+	}
+
+	if c.Direction != "next" && c.Direction != "prev" {
+		return nil, errors.New("Invalid cursor: unknown direction '" + c.Direction + "'")
+	}
+
+	return &c, nil
+}
+
+// cursorPosition converts an optional cursor into the nullable arguments the List* queries expect.
+func cursorPosition(c *cursor) (sql.NullTime, uuid.NullUUID) {
+	if c == nil {
+		return sql.NullTime{}, uuid.NullUUID{}
+	}
+	return sql.NullTime{Time: c.CreatedAt, Valid: true}, uuid.NullUUID{UUID: c.ID, Valid: true}
+}
+
+// parsePageParams reads limit, sort and cursor from the query string.
+// Missing values fall back to the first page of DEFAULT_PAGE_LIMIT items in default_sort order.
+func parsePageParams(query url.Values, default_sort string) (pageParams, error) {
+	params := pageParams{
+		Limit: DEFAULT_PAGE_LIMIT,
+		Sort:  default_sort,
+	}
+
+	if limit_string := query.Get("limit"); limit_string != "" {
+		limit, err := strconv.Atoi(limit_string)
+		if err != nil || limit < 1 {
+			return pageParams{}, errors.New("limit must be a positive integer")
+		}
+		if limit > MAX_PAGE_LIMIT {
+			limit = MAX_PAGE_LIMIT
+		}
+		params.Limit = limit
+	}
+
+	switch sortq := query.Get("sort"); sortq {
+	case "":
+	case "asc", "desc":
+		params.Sort = sortq
+	default:
+		return pageParams{}, errors.New("sort must be either 'asc' or 'desc'")
+	}
+
+	if cursor_string := query.Get("cursor"); cursor_string != "" {
+		c, err := decodeCursor(cursor_string)
+		if err != nil {
+			return pageParams{}, err
+		}
+		params.Cursor = c
+	}
+
+	return params, nil
+}
+
+// setPaginationLinks writes an RFC 8288 Link header (and X-Next-Cursor / X-Prev-Cursor helpers)
+// pointing at the neighbouring pages, keeping every other query parameter of the request.
+func setPaginationLinks(response_writer http.ResponseWriter, req *http.Request, next_cursor, prev_cursor string) {
+	links := []string{}
+	build := func(cursor_string, rel string) {
+		query := req.URL.Query()
+		query.Set("cursor", cursor_string)
+		links = append(links, "<"+req.URL.Path+"?"+query.Encode()+`>; rel="`+rel+`"`)
+	}
+
+	if next_cursor != "" {
+		build(next_cursor, "next")
+		response_writer.Header().Set("X-Next-Cursor", next_cursor)
+	}
+	if prev_cursor != "" {
+		build(prev_cursor, "prev")
+		response_writer.Header().Set("X-Prev-Cursor", prev_cursor)
+	}
+
+	if len(links) > 0 {
+		response_writer.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// fetchPageFunc loads up to limit rows strictly after (ascending) or strictly before (descending) the cursor.
+// A nil cursor means "from the very beginning" in the given direction.
+type fetchPageFunc[T any] func(ascending bool, c *cursor, limit int32) ([]T, error)
+
+// paginate runs fetch in the right direction for the requested sort and cursor,
+// and returns the page in display order together with the cursors of its neighbours.
+func paginate[T any](params pageParams, fetch fetchPageFunc[T], position func(T) (time.Time, uuid.UUID)) ([]T, string, string, error) {
+	return paginateBy(params, fetch, func(item T) cursor {
+		created_at, id := position(item)
+		return cursor{CreatedAt: created_at, ID: id}
+	})
+}
+
+// paginateBy is paginate for listings ordered by more than (created_at, id): position fills in every field the order uses.
+func paginateBy[T any](params pageParams, fetch fetchPageFunc[T], position func(T) cursor) ([]T, string, string, error) {
+	is_prev := params.Cursor != nil && params.Cursor.Direction == "prev"
+	ascending := (params.Sort == "asc") != is_prev
+
+	items, err := fetch(ascending, params.Cursor, int32(params.Limit+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	has_more := len(items) > params.Limit
+	if has_more {
+		items = items[:params.Limit]
+	}
+
+	if is_prev {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+
+	has_next, has_prev := has_more, params.Cursor != nil
+	if is_prev {
+		has_next, has_prev = true, has_more
+	}
+
+	next_cursor, prev_cursor := "", ""
+	if len(items) > 0 {
+		if has_next {
+			next := position(items[len(items)-1])
+			next.Direction = "next"
+			next_cursor = encodeCursor(next)
+		}
+		if has_prev {
+			prev := position(items[0])
+			prev.Direction = "prev"
+			prev_cursor = encodeCursor(prev)
+		}
+	}
+
+	return items, next_cursor, prev_cursor, nil
+}
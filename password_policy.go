@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/OmarJarbou/Chirpy/internal/auth"
+)
+
+type passwordPolicyErrorResponseBody struct {
+	Error      string                         `json:"error"`
+	Violations []auth.PasswordPolicyViolation `json:"violations"`
+}
+
+// enforcePasswordPolicy answers 400 with every rule the password breaks, and reports whether it was acceptable.
+func (cfg *apiConfig) enforcePasswordPolicy(response_writer http.ResponseWriter, password string, email string) bool {
+	violations := cfg.PasswordPolicy.Check(password, email)
+	if len(violations) == 0 {
+		return true
+	}
+
+	errorResBody := passwordPolicyErrorResponseBody{
+		Error:      "Password doesn't meet the password policy",
+		Violations: violations,
+	}
+	jsonResBody, err := json.Marshal(errorResBody)
+	writeJSONResponse(response_writer, jsonResBody, err, 400)
+	return false
+}
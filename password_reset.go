@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/OmarJarbou/Chirpy/internal/auth"
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/OmarJarbou/Chirpy/internal/mailer"
+)
+
+const PASSWORD_RESET_EXP_TIME = 30 * time.Minute
+
+// Reset requests are counted like failed logins, under keys of their own: every one of them sends an email,
+// so an address gets few before it's locked. The counts are never taken back, and start over after 24 hours.
+const PASSWORD_RESET_FREE_REQUESTS_PER_ACCOUNT = 3
+const PASSWORD_RESET_FREE_REQUESTS_PER_IP = 20
+
+const PASSWORD_RESET_LOCKOUT_BASE = time.Minute
+const PASSWORD_RESET_LOCKOUT_MAX = time.Hour
+
+type passwordResetRequestBody struct {
+	Email string `json:"email"`
+}
+
+type passwordResetConfirmBody struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type passwordResetSuccessResponseBody struct {
+	Message string `json:"message"`
+}
+
+// sendPasswordReset emails a reset token to the user with this address, if there is one.
+// It runs after the response was sent, so neither the answer nor its timing tells whether the address is in use.
+func (cfg *apiConfig) sendPasswordReset(email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	user, err := cfg.DBQueries.GetUserByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error while fetching user for password reset: %v", err)
+		return
+	}
+
+	token, err2 := auth.MakePasswordResetToken()
+	if err2 != nil {
+		log.Printf("Error while making password reset token for user %s: %v", user.ID, err2)
+		return
+	}
+
+	err3 := cfg.DBQueries.CreatePasswordResetToken(ctx, database.CreatePasswordResetTokenParams{
+		TokenHash: auth.HashPasswordResetToken(token, cfg.RefreshTokenKey),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(PASSWORD_RESET_EXP_TIME),
+	})
+	if err3 != nil {
+		log.Printf("Error while saving password reset token for user %s: %v", user.ID, err3)
+		return
+	}
+
+	err4 := cfg.Mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body:    "Hi @" + user.Handle + ",\n\nSomebody asked to reset the password of your Chirpy account. Send this token with your new password to POST " + cfg.PublicURL + "/api/password-reset/confirm within 30 minutes:\n\n" + token + "\n\nIf it wasn't you, you can ignore this email: your password stays the same.\n",
+	})
+	if err4 != nil {
+		log.Printf("Error while sending password reset email to user %s: %v", user.ID, err4)
+	}
+}
+
+func (cfg *apiConfig) handleRequestPasswordReset(response_writer http.ResponseWriter, req *http.Request) {
+	reqBody := passwordResetRequestBody{}
+	errorResBody := errorResponseBody{}
+
+	if err := json.NewDecoder(req.Body).Decode(&reqBody); err != nil {
+		errorResBody.Error = "Error while decoding request's json " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	if reqBody.Email == "" {
+		errorResBody.Error = "Email is required"
+		jsonResBody, err3 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err3, 400)
+		return
+	}
+
+	// emails without an account are counted and locked the same way, so a 429 doesn't tell whether one uses the address
+	account_key, ip_key := loginFailureKeys(reqBody.Email, req)
+	retry_after, _, err4 := cfg.startAttempt(req.Context(),
+		attemptLimit{"password-reset:" + account_key, PASSWORD_RESET_FREE_REQUESTS_PER_ACCOUNT, PASSWORD_RESET_LOCKOUT_BASE, PASSWORD_RESET_LOCKOUT_MAX},
+		attemptLimit{"password-reset:" + ip_key, PASSWORD_RESET_FREE_REQUESTS_PER_IP, PASSWORD_RESET_LOCKOUT_BASE, PASSWORD_RESET_LOCKOUT_MAX},
+	)
+	if err4 != nil {
+		errorResBody.Error = err4.Error()
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 500)
+		return
+	}
+	if retry_after > 0 {
+		writeTooManyAttemptsResponse(response_writer, "Too many password reset requests", retry_after)
+		return
+	}
+
+	go cfg.sendPasswordReset(reqBody.Email)
+
+	successResBody := passwordResetSuccessResponseBody{
+		Message: "If an account uses this email, a password reset token was sent to it",
+	}
+	jsonResBody, err6 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err6, 202)
+}
+
+// handleConfirmPasswordReset sets a new password with a reset token, and logs the user out everywhere:
+// whoever made them forget their password may well be logged in as them.
+// Two-factor authentication is left on, or a reset email would be all it takes to get around it;
+// users who lost their authenticator as well log in with a recovery code.
+func (cfg *apiConfig) handleConfirmPasswordReset(response_writer http.ResponseWriter, req *http.Request) {
+	reqBody := passwordResetConfirmBody{}
+	errorResBody := errorResponseBody{}
+
+	if err := json.NewDecoder(req.Body).Decode(&reqBody); err != nil {
+		errorResBody.Error = "Error while decoding request's json " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	tx, err3 := cfg.DB.BeginTx(req.Context(), nil)
+	if err3 != nil {
+		errorResBody.Error = "Error while starting transaction: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+	defer tx.Rollback()
+	queries := cfg.DBQueries.WithTx(tx)
+
+	user_id, err5 := queries.UsePasswordResetToken(req.Context(), auth.HashPasswordResetToken(reqBody.Token, cfg.RefreshTokenKey))
+	if errors.Is(err5, sql.ErrNoRows) {
+		errorResBody.Error = "Reset token is invalid, expired or already used"
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 400)
+		return
+	}
+	if err5 != nil {
+		errorResBody.Error = "Error while checking reset token: " + err5.Error()
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 500)
+		return
+	}
+
+	user, err8 := queries.GetUserById(req.Context(), user_id)
+	if err8 != nil {
+		errorResBody.Error = "Error while fetching user: " + err8.Error()
+		jsonResBody, err9 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err9, 500)
+		return
+	}
+
+	// a refused password rolls the transaction back, so the token can be used again with a better one
+	if !cfg.enforcePasswordPolicy(response_writer, reqBody.Password, user.Email) {
+		return
+	}
+
+	hashed, err10 := auth.HashPassword(reqBody.Password)
+	if err10 != nil {
+		errorResBody.Error = err10.Error()
+		jsonResBody, err11 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err11, 400)
+		return
+	}
+
+	err12 := queries.UpdateUserPassword(req.Context(), database.UpdateUserPasswordParams{
+		ID:             user_id,
+		HashedPassword: hashed,
+	})
+	if err12 != nil {
+		errorResBody.Error = "Error while updating password: " + err12.Error()
+		jsonResBody, err13 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err13, 500)
+		return
+	}
+
+	// the other tokens sent before this one are of no use anymore
+	if err14 := queries.ExpirePasswordResetTokens(req.Context(), user_id); err14 != nil {
+		errorResBody.Error = "Error while expiring reset tokens: " + err14.Error()
+		jsonResBody, err15 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err15, 500)
+		return
+	}
+
+	if err16 := queries.RevokeAllSessions(req.Context(), user_id); err16 != nil {
+		errorResBody.Error = "Error while revoking sessions: " + err16.Error()
+		jsonResBody, err17 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err17, 500)
+		return
+	}
+
+	// personal access tokens don't belong to a session, so they are revoked on their own
+	if err18 := queries.RevokeAllPersonalAccessTokens(req.Context(), user_id); err18 != nil {
+		errorResBody.Error = "Error while revoking personal access tokens: " + err18.Error()
+		jsonResBody, err19 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err19, 500)
+		return
+	}
+
+	if err20 := tx.Commit(); err20 != nil {
+		errorResBody.Error = "Error while committing password reset: " + err20.Error()
+		jsonResBody, err21 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err21, 500)
+		return
+	}
+
+	response_writer.WriteHeader(204)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/OmarJarbou/Chirpy/internal/auth"
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+const SCOPE_CHIRPS_READ = "chirps:read"
+const SCOPE_CHIRPS_WRITE = "chirps:write"
+const SCOPE_PROFILE_WRITE = "profile:write"
+
+var personalAccessTokenScopes = []string{SCOPE_CHIRPS_READ, SCOPE_CHIRPS_WRITE, SCOPE_PROFILE_WRITE}
+
+const MAX_PERSONAL_ACCESS_TOKEN_DAYS = 365
+
+type createPersonalAccessTokenRequestBody struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+type personalAccessTokenResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// only sent once, when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+func nullTimePointer(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func newPersonalAccessTokenResponse(token database.PersonalAccessToken) personalAccessTokenResponse {
+	return personalAccessTokenResponse{
+		ID:         token.ID.String(),
+		Name:       token.Name,
+		Scopes:     token.Scopes,
+		CreatedAt:  token.CreatedAt,
+		ExpiresAt:  nullTimePointer(token.ExpiresAt),
+		LastUsedAt: nullTimePointer(token.LastUsedAt),
+	}
+}
+
+func hasAllScopes(granted []string, required []string) bool {
+	for _, scope := range required {
+		if !slices.Contains(granted, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupPersonalAccessToken finds the token in the database. invalid_reason says why it can't be used, "" when it can.
+func (cfg *apiConfig) lookupPersonalAccessToken(ctx context.Context, token_string string) (database.GetPersonalAccessTokenByHashRow, string, error) {
+	row, err := cfg.DBQueries.GetPersonalAccessTokenByHash(ctx, auth.HashPersonalAccessToken(token_string, cfg.RefreshTokenKey))
+	if errors.Is(err, sql.ErrNoRows) {
+		return row, "Personal access token doesn't exist", nil
+	}
+	if err != nil {
+		return row, "", errors.New("Error while fetching personal access token from database: " + err.Error())
+	}
+
+	token := row.PersonalAccessToken
+	if token.RevokedAt.Valid {
+		return row, "Personal access token is revoked", nil
+	}
+	if token.ExpiresAt.Valid && token.ExpiresAt.Time.Before(time.Now()) {
+		return row, "Personal access token is expired", nil
+	}
+	return row, "", nil
+}
+
+// authorizePersonalAccessToken is the part of middlewareAuthorize for personal access tokens.
+// Routes that don't list scopes (sessions, notifications, managing tokens...) can only be used with a login.
+func (cfg *apiConfig) authorizePersonalAccessToken(response_writer http.ResponseWriter, req *http.Request, token_string string, scopes []string, next http.Handler) {
+	errorResBody := errorResponseBody{}
+
+	if len(scopes) == 0 {
+		response_writer.Header().Set("WWW-Authenticate", `Bearer realm="chirpy", error="insufficient_scope"`)
+		errorResBody.Error = "Personal access tokens can't be used on this route"
+		jsonResBody, err := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err, 403)
+		return
+	}
+
+	row, invalid_reason, err2 := cfg.lookupPersonalAccessToken(req.Context(), token_string)
+	if err2 != nil {
+		errorResBody.Error = err2.Error()
+		jsonResBody, err3 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err3, 500)
+		return
+	}
+	if invalid_reason != "" {
+		response_writer.Header().Set("WWW-Authenticate", `Bearer realm="chirpy", error="invalid_token"`)
+		errorResBody.Error = invalid_reason
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 401)
+		return
+	}
+	token := row.PersonalAccessToken
+
+	for _, scope := range scopes {
+		if !slices.Contains(token.Scopes, scope) {
+			response_writer.Header().Set("WWW-Authenticate", `Bearer realm="chirpy", error="insufficient_scope", scope="`+strings.Join(scopes, " ")+`"`)
+			errorResBody.Error = "Personal access token is missing the " + scope + " scope"
+			jsonResBody, err5 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err5, 403)
+			return
+		}
+	}
+
+	if err6 := cfg.DBQueries.TouchPersonalAccessToken(req.Context(), token.ID); err6 != nil {
+		errorResBody.Error = "Error while updating personal access token: " + err6.Error()
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 500)
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), "user_id", token.UserID)
+	ctx = context.WithValue(ctx, "role", row.UserRole)
+	next.ServeHTTP(response_writer, req.WithContext(ctx))
+}
+
+func (cfg *apiConfig) handleCreatePersonalAccessToken(response_writer http.ResponseWriter, req *http.Request) {
+	reqBody := createPersonalAccessTokenRequestBody{}
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	if err := json.NewDecoder(req.Body).Decode(&reqBody); err != nil {
+		errorResBody.Error = "Error while decoding request's json " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	name := strings.TrimSpace(reqBody.Name)
+	if name == "" || len(name) > 100 {
+		errorResBody.Error = "Token name must be 1 to 100 characters long"
+		jsonResBody, err3 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err3, 400)
+		return
+	}
+
+	if len(reqBody.Scopes) == 0 {
+		errorResBody.Error = "Token needs at least one scope, out of: " + strings.Join(personalAccessTokenScopes, ", ")
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 400)
+		return
+	}
+	scopes := []string{}
+	for _, scope := range reqBody.Scopes {
+		if !slices.Contains(personalAccessTokenScopes, scope) {
+			errorResBody.Error = "Unknown scope " + scope + ", scopes are: " + strings.Join(personalAccessTokenScopes, ", ")
+			jsonResBody, err5 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err5, 400)
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	// 0 means the token never expires
+	if reqBody.ExpiresInDays < 0 || reqBody.ExpiresInDays > MAX_PERSONAL_ACCESS_TOKEN_DAYS {
+		errorResBody.Error = "expires_in_days must be between 1 and 365, or left out for a token that doesn't expire"
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 400)
+		return
+	}
+	expires_at := sql.NullTime{}
+	if reqBody.ExpiresInDays > 0 {
+		expires_at = sql.NullTime{Time: time.Now().AddDate(0, 0, reqBody.ExpiresInDays), Valid: true}
+	}
+
+	token_string, err7 := auth.MakePersonalAccessToken()
+	if err7 != nil {
+		errorResBody.Error = err7.Error()
+		jsonResBody, err8 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err8, 500)
+		return
+	}
+
+	token, err9 := cfg.DBQueries.CreatePersonalAccessToken(req.Context(), database.CreatePersonalAccessTokenParams{
+		UserID:    user_id,
+		Name:      name,
+		TokenHash: auth.HashPersonalAccessToken(token_string, cfg.RefreshTokenKey),
+		Scopes:    scopes,
+		ExpiresAt: expires_at,
+	})
+	if err9 != nil {
+		errorResBody.Error = "Error while creating personal access token: " + err9.Error()
+		jsonResBody, err10 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err10, 500)
+		return
+	}
+
+	successResBody := newPersonalAccessTokenResponse(token)
+	successResBody.Token = token_string
+	jsonResBody, err11 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err11, 201)
+}
+
+func (cfg *apiConfig) handleGetPersonalAccessTokens(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	tokens, err := cfg.DBQueries.ListPersonalAccessTokens(req.Context(), user_id)
+	if err != nil {
+		errorResBody.Error = "Error while fetching personal access tokens from database: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 500)
+		return
+	}
+
+	successResBody := []personalAccessTokenResponse{}
+	for _, token := range tokens {
+		successResBody = append(successResBody, newPersonalAccessTokenResponse(token))
+	}
+
+	jsonResBody, err3 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err3, 200)
+}
+
+func (cfg *apiConfig) handleRevokePersonalAccessToken(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	token_id, err := uuid.Parse(req.PathValue("tokenID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing token id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	rows, err3 := cfg.DBQueries.RevokePersonalAccessToken(req.Context(), database.RevokePersonalAccessTokenParams{
+		ID:     token_id,
+		UserID: user_id,
+	})
+	if err3 != nil {
+		errorResBody.Error = "Error while revoking personal access token: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	if rows == 0 {
+		errorResBody.Error = "No active personal access token with this id"
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 404)
+		return
+	}
+
+	response_writer.WriteHeader(204)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+// referencedChirp is the chirp a rechirp or a quote points at.
+// Once that chirp is deleted only its id is left, with Unavailable set, so clients can render a placeholder.
+type referencedChirp struct {
+	*Chirp
+	ID          string `json:"id"`
+	Unavailable bool   `json:"unavailable,omitempty"`
+}
+
+// addReferencedChirps embeds the rechirped / quoted chirp into every chirp of the slice, loading them all with a single query.
+func (cfg *apiConfig) addReferencedChirps(ctx context.Context, chirps []Chirp) error {
+	ids := []uuid.UUID{}
+	for _, chirp := range chirps {
+		for _, reference := range []string{chirp.RechirpOf, chirp.QuoteOf} {
+			if reference != "" {
+				ids = append(ids, uuid.MustParse(reference))
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := cfg.DBQueries.GetChirpsByIds(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	found := map[string]database.Chirp{}
+	for _, row := range rows {
+		found[row.ID.String()] = row
+	}
+
+	reference := func(id string) *referencedChirp {
+		if id == "" {
+			return nil
+		}
+		original, ok := found[id]
+		if !ok || original.DeletedAt.Valid {
+			return &referencedChirp{ID: id, Unavailable: true}
+		}
+		original_response := newChirpResponse(original)
+		return &referencedChirp{Chirp: &original_response, ID: id}
+	}
+
+	for i := range chirps {
+		chirps[i].RechirpedChirp = reference(chirps[i].RechirpOf)
+		chirps[i].QuotedChirp = reference(chirps[i].QuoteOf)
+	}
+
+	return nil
+}
+
+// addRechirpStats fills rechirp_count and viewer_rechirped on every chirp of the slice with a single query.
+func (cfg *apiConfig) addRechirpStats(ctx context.Context, chirps []Chirp, viewer_id uuid.NullUUID) error {
+	if len(chirps) == 0 {
+		return nil
+	}
+
+	chirp_ids := []uuid.UUID{}
+	for _, chirp := range chirps {
+		chirp_ids = append(chirp_ids, uuid.MustParse(chirp.ID))
+	}
+
+	stats, err := cfg.DBQueries.GetChirpRechirpStats(ctx, database.GetChirpRechirpStatsParams{
+		ViewerID: viewer_id,
+		ChirpIds: chirp_ids,
+	})
+	if err != nil {
+		return err
+	}
+
+	stats_by_chirp := map[string]database.GetChirpRechirpStatsRow{}
+	for _, stat := range stats {
+		stats_by_chirp[stat.ChirpID.String()] = stat
+	}
+
+	for i := range chirps {
+		stat := stats_by_chirp[chirps[i].ID]
+		chirps[i].RechirpCount = stat.RechirpCount
+		chirps[i].ViewerRechirped = stat.ViewerRechirped
+	}
+
+	return nil
+}
+
+// getOriginalChirp loads a chirp that is about to be rechirped, quoted or replied to.
+// Rechirps are resolved to the chirp they repost, and deleted chirps are reported as missing.
+func (cfg *apiConfig) getOriginalChirp(ctx context.Context, chirp_id uuid.UUID) (database.Chirp, bool) {
+	chirp, err := cfg.DBQueries.GetChirpById(ctx, chirp_id)
+	if err != nil || chirp.DeletedAt.Valid {
+		return database.Chirp{}, false
+	}
+
+	if chirp.RechirpOf.Valid {
+		return cfg.getOriginalChirp(ctx, chirp.RechirpOf.UUID)
+	}
+
+	return chirp, true
+}
+
+func (cfg *apiConfig) handleRechirp(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	chirp_uuid, err := uuid.Parse(req.PathValue("chirpID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing chirp id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	original, ok := cfg.getOriginalChirp(req.Context(), chirp_uuid)
+	if !ok {
+		errorResBody.Error = "No chirp with this id"
+		jsonResBody, err3 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err3, 404)
+		return
+	}
+
+	_, err4 := cfg.DBQueries.GetRechirp(req.Context(), database.GetRechirpParams{
+		UserID:    user_id,
+		RechirpOf: uuid.NullUUID{UUID: original.ID, Valid: true},
+	})
+	if err4 == nil {
+		errorResBody.Error = "You already rechirped this chirp"
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 409)
+		return
+	}
+
+	rechirp, err6 := cfg.DBQueries.CreateRechirp(req.Context(), database.CreateRechirpParams{
+		UserID:    user_id,
+		RechirpOf: original.ID,
+	})
+	// a concurrent request for the same rechirp can get in between GetRechirp and here
+	if isUniqueViolation(err6, "uq_chirps_user_rechirp") {
+		errorResBody.Error = "You already rechirped this chirp"
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 409)
+		return
+	}
+	if err6 != nil {
+		errorResBody.Error = "Error while creating rechirp: " + err6.Error()
+		jsonResBody, err8 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err8, 500)
+		return
+	}
+
+	successResBody := []Chirp{newChirpResponse(rechirp)}
+	if err9 := cfg.decorateChirps(req.Context(), successResBody, viewerID(req)); err9 != nil {
+		errorResBody.Error = "Error while fetching chirp details from database: " + err9.Error()
+		jsonResBody, err10 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err10, 500)
+		return
+	}
+
+	cfg.publishChirpCreated(successResBody[0])
+
+	jsonResBody, err11 := json.Marshal(successResBody[0])
+	writeJSONResponse(response_writer, jsonResBody, err11, 201)
+}
+
+func (cfg *apiConfig) handleUndoRechirp(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	chirp_uuid, err := uuid.Parse(req.PathValue("chirpID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing chirp id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	rechirp, err3 := cfg.DBQueries.GetRechirp(req.Context(), database.GetRechirpParams{
+		UserID:    user_id,
+		RechirpOf: uuid.NullUUID{UUID: chirp_uuid, Valid: true},
+	})
+	if err3 != nil {
+		errorResBody.Error = "You haven't rechirped this chirp"
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 404)
+		return
+	}
+
+	err5 := cfg.DBQueries.DeleteChirpById(req.Context(), rechirp.ID)
+	if err5 != nil {
+		errorResBody.Error = "Error while deleting rechirp: " + err5.Error()
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 500)
+		return
+	}
+
+	cfg.publishChirpDeleted(rechirp.ID, rechirp.UserID, rechirp.RootID)
+
+	response_writer.WriteHeader(204)
+}
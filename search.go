@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+// chirpSearchRow is a row of SearchChirpsAfter or SearchChirpsBefore, which only differ in order.
+type chirpSearchRow struct {
+	Chirp database.Chirp
+	Rank  float32
+}
+
+type chirpSearchResult struct {
+	Chirp
+	Rank float32 `json:"rank"`
+}
+
+// searchTerms splits text into the lexemes Postgres can safely receive in a to_tsquery expression.
+// Anything that isn't a letter or a digit acts as a separator, so tsquery operators typed by the user can't leak through.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// buildTSQuery turns a search box string into a to_tsquery expression:
+//   - "quoted words" become a phrase query (word <-> word)
+//   - a word ending with * becomes a prefix query (word:*)
+//   - every other word must appear somewhere in the chirp (word & word)
+func buildTSQuery(q string) (string, error) {
+	parts := []string{}
+
+	segments := strings.Split(q, `"`)
+	for i, segment := range segments {
+		// odd segments sit between a pair of quotes
+		if i%2 == 1 && i != len(segments)-1 {
+			terms := searchTerms(segment)
+			if len(terms) > 0 {
+				parts = append(parts, "("+strings.Join(terms, " <-> ")+")")
+			}
+			continue
+		}
+
+		for _, word := range strings.Fields(segment) {
+			is_prefix := strings.HasSuffix(word, "*")
+			terms := searchTerms(word)
+			for j, term := range terms {
+				if is_prefix && j == len(terms)-1 {
+					term += ":*"
+				}
+				parts = append(parts, term)
+			}
+		}
+	}
+
+	if len(parts) == 0 {
+		return "", errors.New("Search query must contain at least one word")
+	}
+
+	return strings.Join(parts, " & "), nil
+}
+
+func (cfg *apiConfig) handleSearchChirps(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	tsquery, err := buildTSQuery(req.URL.Query().Get("q"))
+	if err != nil {
+		errorResBody.Error = err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	// best matches first; sort=asc turns the order around
+	page_params, err3 := parsePageParams(req.URL.Query(), "desc")
+	if err3 != nil {
+		errorResBody.Error = err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 400)
+		return
+	}
+
+	author_uuid := uuid.NullUUID{}
+	author_id := req.URL.Query().Get("author_id")
+	if author_id != "" {
+		parsed_author_id, err5 := uuid.Parse(author_id)
+		if err5 != nil {
+			errorResBody.Error = "Invalid UUID: " + err5.Error()
+			jsonResBody, err6 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err6, 400)
+			return
+		}
+		author_uuid = uuid.NullUUID{UUID: parsed_author_id, Valid: true}
+	}
+
+	fetch := func(ascending bool, c *cursor, limit int32) ([]chirpSearchRow, error) {
+		cursor_created_at, cursor_id := cursorPosition(c)
+		cursor_rank := sql.NullFloat64{}
+		if c != nil {
+			cursor_rank = sql.NullFloat64{Float64: float64(c.Rank), Valid: true}
+		}
+
+		found := []chirpSearchRow{}
+		if ascending {
+			rows, err := cfg.DBQueries.SearchChirpsAfter(req.Context(), database.SearchChirpsAfterParams{
+				Query:           tsquery,
+				AuthorID:        author_uuid,
+				CursorCreatedAt: cursor_created_at,
+				CursorRank:      cursor_rank,
+				CursorID:        cursor_id,
+				PageLimit:       limit,
+			})
+			for _, row := range rows {
+				found = append(found, chirpSearchRow{Chirp: row.Chirp, Rank: row.Rank})
+			}
+			return found, err
+		}
+		rows, err := cfg.DBQueries.SearchChirpsBefore(req.Context(), database.SearchChirpsBeforeParams{
+			Query:           tsquery,
+			AuthorID:        author_uuid,
+			CursorCreatedAt: cursor_created_at,
+			CursorRank:      cursor_rank,
+			CursorID:        cursor_id,
+			PageLimit:       limit,
+		})
+		for _, row := range rows {
+			found = append(found, chirpSearchRow{Chirp: row.Chirp, Rank: row.Rank})
+		}
+		return found, err
+	}
+	position := func(row chirpSearchRow) cursor {
+		return cursor{Rank: row.Rank, CreatedAt: row.Chirp.CreatedAt, ID: row.Chirp.ID}
+	}
+
+	rows, next_cursor, prev_cursor, err7 := paginateBy(page_params, fetch, position)
+	if err7 != nil {
+		errorResBody.Error = "Error while searching chirps: " + err7.Error()
+		jsonResBody, err8 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err8, 500)
+		return
+	}
+
+	chirps := []Chirp{}
+	for _, row := range rows {
+		chirps = append(chirps, newChirpResponse(row.Chirp))
+	}
+
+	if err9 := cfg.decorateChirps(req.Context(), chirps, viewerID(req)); err9 != nil {
+		errorResBody.Error = "Error while fetching chirp details from database: " + err9.Error()
+		jsonResBody, err10 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err10, 500)
+		return
+	}
+
+	successResBody := []chirpSearchResult{}
+
+	for i, row := range rows {
+		successResBody = append(successResBody, chirpSearchResult{
+			Chirp: chirps[i],
+			Rank:  row.Rank,
+		})
+	}
+
+	setPaginationLinks(response_writer, req, next_cursor, prev_cursor)
+	jsonResBody, err11 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err11, 200)
+}
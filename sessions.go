@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+type sessionResponse struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+}
+
+// clientIP is the address the request came from. Forwarding headers are ignored since anybody can set them.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func newSessionResponse(row database.ListActiveSessionsRow) sessionResponse {
+	return sessionResponse{
+		ID:         row.Session.ID.String(),
+		CreatedAt:  row.Session.CreatedAt,
+		LastUsedAt: row.Session.LastUsedAt,
+		ExpiresAt:  row.ExpiresAt,
+		UserAgent:  row.Session.UserAgent,
+		IPAddress:  row.Session.IpAddress,
+	}
+}
+
+func (cfg *apiConfig) handleGetSessions(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	rows, err := cfg.DBQueries.ListActiveSessions(req.Context(), user_id)
+	if err != nil {
+		errorResBody.Error = "Error while fetching sessions from database: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 500)
+		return
+	}
+
+	successResBody := []sessionResponse{}
+	for _, row := range rows {
+		successResBody = append(successResBody, newSessionResponse(row))
+	}
+
+	jsonResBody, err3 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err3, 200)
+}
+
+// handleRevokeSession logs a session out by revoking its refresh token.
+// Access tokens already handed to it keep working until they expire.
+func (cfg *apiConfig) handleRevokeSession(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	session_id, err := uuid.Parse(req.PathValue("sessionID"))
+	if err != nil {
+		errorResBody.Error = "Error while parsing session id string to uuid: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	rows, err3 := cfg.DBQueries.RevokeSession(req.Context(), database.RevokeSessionParams{
+		ID:     session_id,
+		UserID: user_id,
+	})
+	if err3 != nil {
+		errorResBody.Error = "Error while revoking session: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	if rows == 0 {
+		errorResBody.Error = "No active session with this id"
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 404)
+		return
+	}
+
+	response_writer.WriteHeader(204)
+}
+
+func (cfg *apiConfig) handleRevokeAllSessions(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	err := cfg.DBQueries.RevokeAllSessions(req.Context(), user_id)
+	if err != nil {
+		errorResBody.Error = "Error while revoking sessions: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 500)
+		return
+	}
+
+	response_writer.WriteHeader(204)
+}
@@ -1,14 +1,54 @@
 -- name: CreateChirp :one
-INSERT INTO chirps (id, created_at, updated_at, body, user_id)
-VALUES (
-    gen_random_uuid(),
+INSERT INTO chirps (id, created_at, updated_at, body, user_id, in_reply_to, root_id, quote_of)
+SELECT
+    new_chirp.id,
     NOW(),
     NOW(),
-    $1,
-    $2
-)
+    sqlc.arg('body')::text,
+    sqlc.arg('user_id')::uuid,
+    sqlc.narg('in_reply_to')::uuid,
+    COALESCE(parent.root_id, new_chirp.id),
+    sqlc.narg('quote_of')::uuid
+FROM (SELECT gen_random_uuid() AS id) AS new_chirp
+LEFT JOIN chirps AS parent ON parent.id = sqlc.narg('in_reply_to')::uuid
+RETURNING *;
+
+-- name: CreateRechirp :one
+INSERT INTO chirps (id, created_at, updated_at, body, user_id, root_id, rechirp_of)
+SELECT
+    new_chirp.id,
+    NOW(),
+    NOW(),
+    '',
+    sqlc.arg('user_id')::uuid,
+    new_chirp.id,
+    sqlc.arg('rechirp_of')::uuid
+FROM (SELECT gen_random_uuid() AS id) AS new_chirp
 RETURNING *;
 
+-- name: GetRechirp :one
+SELECT * FROM chirps
+WHERE user_id = $1 AND rechirp_of = $2 AND deleted_at IS NULL;
+
+-- name: DeleteRechirpsOf :many
+DELETE FROM chirps
+WHERE rechirp_of = $1
+RETURNING id, user_id;
+
+-- name: GetChirpsByIds :many
+SELECT * FROM chirps
+WHERE id = ANY(sqlc.arg('ids')::uuid[]);
+
+-- name: GetChirpRechirpStats :many
+SELECT
+    rechirp_of::uuid AS chirp_id,
+    COUNT(*) AS rechirp_count,
+    COALESCE(BOOL_OR(user_id = sqlc.narg('viewer_id')::uuid), false)::boolean AS viewer_rechirped
+FROM chirps
+WHERE rechirp_of = ANY(sqlc.arg('chirp_ids')::uuid[])
+AND deleted_at IS NULL
+GROUP BY rechirp_of;
+
 -- name: GetAllChirps :many
 SELECT * FROM chirps
 ORDER BY created_at ASC;
@@ -17,6 +57,11 @@ ORDER BY created_at ASC;
 SELECT * FROM chirps
 WHERE id = $1;
 
+-- name: GetChirpByIdForUpdate :one
+SELECT * FROM chirps
+WHERE id = $1
+FOR UPDATE;
+
 -- name: DeleteChirpById :exec
 DELETE FROM chirps
 WHERE id = $1;
@@ -24,4 +69,130 @@ WHERE id = $1;
 -- name: GetAllChirpsForAUser :many
 SELECT * FROM chirps
 WHERE user_id = $1
-ORDER BY created_at ASC;
\ No newline at end of file
+ORDER BY created_at ASC;
+
+-- name: ListChirpsAfter :many
+SELECT * FROM chirps
+WHERE deleted_at IS NULL
+AND (sqlc.narg('author_id')::uuid IS NULL OR user_id = sqlc.narg('author_id')::uuid)
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (created_at, id) > (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY created_at ASC, id ASC
+LIMIT sqlc.arg('page_limit');
+
+-- name: ListChirpsBefore :many
+SELECT * FROM chirps
+WHERE deleted_at IS NULL
+AND (sqlc.narg('author_id')::uuid IS NULL OR user_id = sqlc.narg('author_id')::uuid)
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (created_at, id) < (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg('page_limit');
+
+-- name: SearchChirpsAfter :many
+SELECT sqlc.embed(chirps), ts_rank(search_vector, to_tsquery('english', sqlc.arg('query'))) AS rank
+FROM chirps
+WHERE deleted_at IS NULL
+AND search_vector @@ to_tsquery('english', sqlc.arg('query'))
+AND (sqlc.narg('author_id')::uuid IS NULL OR user_id = sqlc.narg('author_id')::uuid)
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (ts_rank(search_vector, to_tsquery('english', sqlc.arg('query'))), created_at, id) > (sqlc.narg('cursor_rank')::real, sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY rank ASC, created_at ASC, id ASC
+LIMIT sqlc.arg('page_limit');
+
+-- name: SearchChirpsBefore :many
+SELECT sqlc.embed(chirps), ts_rank(search_vector, to_tsquery('english', sqlc.arg('query'))) AS rank
+FROM chirps
+WHERE deleted_at IS NULL
+AND search_vector @@ to_tsquery('english', sqlc.arg('query'))
+AND (sqlc.narg('author_id')::uuid IS NULL OR user_id = sqlc.narg('author_id')::uuid)
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (ts_rank(search_vector, to_tsquery('english', sqlc.arg('query'))), created_at, id) < (sqlc.narg('cursor_rank')::real, sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY rank DESC, created_at DESC, id DESC
+LIMIT sqlc.arg('page_limit');
+
+-- name: UpdateChirpBody :one
+UPDATE chirps
+SET body = $1, updated_at = NOW()
+WHERE id = $2
+RETURNING *;
+
+-- name: CountChirpReplies :one
+SELECT COUNT(*) FROM chirps
+WHERE in_reply_to = $1;
+
+-- name: TombstoneChirp :one
+UPDATE chirps
+SET body = '', deleted_at = NOW(), updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: DeleteTombstoneWithoutReplies :one
+DELETE FROM chirps
+WHERE id = $1 AND deleted_at IS NOT NULL
+AND NOT EXISTS (SELECT 1 FROM chirps AS replies WHERE replies.in_reply_to = $1)
+RETURNING *;
+
+-- name: GetChirpAncestors :many
+WITH RECURSIVE ancestors AS (
+    SELECT parent.id, parent.in_reply_to, 1 AS depth
+    FROM chirps AS child
+    INNER JOIN chirps AS parent ON parent.id = child.in_reply_to
+    WHERE child.id = $1
+    UNION ALL
+    SELECT chirps.id, chirps.in_reply_to, ancestors.depth + 1
+    FROM chirps
+    INNER JOIN ancestors ON chirps.id = ancestors.in_reply_to
+)
+SELECT sqlc.embed(chirps) FROM ancestors
+INNER JOIN chirps ON chirps.id = ancestors.id
+ORDER BY ancestors.depth DESC;
+
+-- name: GetChirpDescendants :many
+WITH RECURSIVE descendants AS (
+    SELECT chirps.id FROM chirps
+    WHERE chirps.in_reply_to = $1
+    UNION ALL
+    SELECT chirps.id
+    FROM chirps
+    INNER JOIN descendants ON chirps.in_reply_to = descendants.id
+)
+SELECT sqlc.embed(chirps) FROM descendants
+INNER JOIN chirps ON chirps.id = descendants.id
+ORDER BY chirps.created_at ASC, chirps.id ASC;
+
+-- name: ListTimelineAfter :many
+SELECT * FROM chirps
+WHERE deleted_at IS NULL
+AND (
+    user_id = sqlc.arg('user_id')
+    OR user_id IN (SELECT followee_id FROM follows WHERE follower_id = sqlc.arg('user_id'))
+)
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (created_at, id) > (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY created_at ASC, id ASC
+LIMIT sqlc.arg('page_limit');
+
+-- name: ListTimelineBefore :many
+SELECT * FROM chirps
+WHERE deleted_at IS NULL
+AND (
+    user_id = sqlc.arg('user_id')
+    OR user_id IN (SELECT followee_id FROM follows WHERE follower_id = sqlc.arg('user_id'))
+)
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (created_at, id) < (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg('page_limit');
\ No newline at end of file
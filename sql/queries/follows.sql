@@ -0,0 +1,72 @@
+-- name: FollowUser :execrows
+INSERT INTO follows (follower_id, followee_id, created_at)
+VALUES (
+    $1,
+    $2,
+    NOW()
+)
+ON CONFLICT (follower_id, followee_id) DO NOTHING;
+
+-- name: UnfollowUser :execrows
+DELETE FROM follows
+WHERE follower_id = $1 AND followee_id = $2;
+
+-- name: CountFollowers :one
+SELECT COUNT(*) FROM follows
+WHERE followee_id = $1;
+
+-- name: CountFollowing :one
+SELECT COUNT(*) FROM follows
+WHERE follower_id = $1;
+
+-- name: ListFollowersAfter :many
+SELECT users.id, users.is_chirpy_red, follows.created_at AS followed_at
+FROM follows
+INNER JOIN users ON users.id = follows.follower_id
+WHERE follows.followee_id = sqlc.arg('user_id')
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (follows.created_at, follows.follower_id) > (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY follows.created_at ASC, follows.follower_id ASC
+LIMIT sqlc.arg('page_limit');
+
+-- name: ListFollowersBefore :many
+SELECT users.id, users.is_chirpy_red, follows.created_at AS followed_at
+FROM follows
+INNER JOIN users ON users.id = follows.follower_id
+WHERE follows.followee_id = sqlc.arg('user_id')
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (follows.created_at, follows.follower_id) < (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY follows.created_at DESC, follows.follower_id DESC
+LIMIT sqlc.arg('page_limit');
+
+-- name: ListFollowingAfter :many
+SELECT users.id, users.is_chirpy_red, follows.created_at AS followed_at
+FROM follows
+INNER JOIN users ON users.id = follows.followee_id
+WHERE follows.follower_id = sqlc.arg('user_id')
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (follows.created_at, follows.followee_id) > (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY follows.created_at ASC, follows.followee_id ASC
+LIMIT sqlc.arg('page_limit');
+
+-- name: ListFollowingBefore :many
+SELECT users.id, users.is_chirpy_red, follows.created_at AS followed_at
+FROM follows
+INNER JOIN users ON users.id = follows.followee_id
+WHERE follows.follower_id = sqlc.arg('user_id')
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (follows.created_at, follows.followee_id) < (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY follows.created_at DESC, follows.followee_id DESC
+LIMIT sqlc.arg('page_limit');
+
+-- name: GetFolloweeIds :many
+SELECT followee_id FROM follows
+WHERE follower_id = $1;
\ No newline at end of file
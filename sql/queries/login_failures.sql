@@ -0,0 +1,29 @@
+-- name: CountLoginAttempt :one
+-- counts the attempt before the password is checked, so parallel guesses each see the count of the ones before.
+-- A locked key isn't counted, the attempt is turned away. Failures older than a day are forgotten, so the count starts over
+INSERT INTO login_failures (key, failures, last_failed_at)
+VALUES ($1, 1, NOW())
+ON CONFLICT (key) DO UPDATE
+SET failures = CASE
+        WHEN login_failures.locked_until > NOW() THEN login_failures.failures
+        WHEN login_failures.last_failed_at < NOW() - INTERVAL '24 hours' THEN 1
+        ELSE login_failures.failures + 1
+    END,
+    last_failed_at = CASE WHEN login_failures.locked_until > NOW() THEN login_failures.last_failed_at ELSE NOW() END
+RETURNING failures, locked_until;
+
+-- name: LockLogin :exec
+UPDATE login_failures
+SET locked_until = $2
+WHERE key = $1;
+
+-- name: UncountLoginAttempt :exec
+-- takes back the attempt of a login that succeeded, along with the lock it set, if it set one
+UPDATE login_failures
+SET failures = GREATEST(failures - 1, 0),
+    locked_until = CASE WHEN sqlc.arg('unlock')::boolean THEN NULL ELSE locked_until END
+WHERE key = sqlc.arg('key');
+
+-- name: ClearLoginFailures :exec
+DELETE FROM login_failures
+WHERE key = $1;
\ No newline at end of file
@@ -0,0 +1,7 @@
+-- name: AddChirpMentions :many
+INSERT INTO mentions (chirp_id, user_id, created_at)
+SELECT sqlc.arg('chirp_id'), users.id, sqlc.arg('created_at')
+FROM users
+WHERE users.handle = ANY(sqlc.arg('handles')::text[])
+ON CONFLICT (chirp_id, user_id) DO NOTHING
+RETURNING user_id;
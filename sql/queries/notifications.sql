@@ -0,0 +1,51 @@
+-- name: CreateNotification :one
+INSERT INTO notifications (id, user_id, kind, actor_id, chirp_id, created_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    $4,
+    NOW()
+)
+RETURNING *;
+
+-- name: ListNotificationsAfter :many
+SELECT sqlc.embed(notifications), actors.handle AS actor_handle
+FROM notifications
+LEFT JOIN users AS actors ON actors.id = notifications.actor_id
+WHERE notifications.user_id = sqlc.arg('user_id')
+AND (NOT sqlc.arg('unread_only')::boolean OR notifications.read_at IS NULL)
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (notifications.created_at, notifications.id) > (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY notifications.created_at ASC, notifications.id ASC
+LIMIT sqlc.arg('page_limit');
+
+-- name: ListNotificationsBefore :many
+SELECT sqlc.embed(notifications), actors.handle AS actor_handle
+FROM notifications
+LEFT JOIN users AS actors ON actors.id = notifications.actor_id
+WHERE notifications.user_id = sqlc.arg('user_id')
+AND (NOT sqlc.arg('unread_only')::boolean OR notifications.read_at IS NULL)
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (notifications.created_at, notifications.id) < (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY notifications.created_at DESC, notifications.id DESC
+LIMIT sqlc.arg('page_limit');
+
+-- name: CountUnreadNotifications :one
+SELECT COUNT(*) FROM notifications
+WHERE user_id = $1 AND read_at IS NULL;
+
+-- name: MarkNotificationRead :execrows
+UPDATE notifications
+SET read_at = COALESCE(read_at, NOW())
+WHERE id = $1 AND user_id = $2;
+
+-- name: MarkAllNotificationsRead :exec
+UPDATE notifications
+SET read_at = NOW()
+WHERE user_id = $1 AND read_at IS NULL;
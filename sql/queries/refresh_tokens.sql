@@ -1,16 +1,27 @@
 -- name: CreateRefreshToken :one
-INSERT INTO refresh_tokens (token, created_at, updated_at, user_id, expires_at, revoked_at)
+INSERT INTO refresh_tokens (token_hash, created_at, updated_at, user_id, expires_at, revoked_at, family_id)
 VALUES (
 $1,
 NOW(),
 NOW(),
 $2,
 $3,
-NULL
+NULL,
+$4
 )
 RETURNING *;
 
 -- name: SetRefreshTokenAsRevoked :exec
 UPDATE refresh_tokens
 SET revoked_at = NOW(), updated_at = NOW()
-WHERE token = $1;
\ No newline at end of file
+WHERE token_hash = $1;
+
+-- name: RotateRefreshToken :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW(), replaced_by = sqlc.arg('replaced_by')
+WHERE token_hash = sqlc.arg('token_hash') AND revoked_at IS NULL AND replaced_by IS NULL;
+
+-- name: RevokeRefreshTokenFamily :exec
+UPDATE refresh_tokens
+SET revoked_at = COALESCE(revoked_at, NOW()), updated_at = NOW()
+WHERE family_id = $1;
\ No newline at end of file
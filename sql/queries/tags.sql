@@ -0,0 +1,55 @@
+-- name: CreateTags :exec
+INSERT INTO tags (id, name, created_at)
+SELECT gen_random_uuid(), name, NOW()
+FROM unnest(sqlc.arg('names')::text[]) AS name
+ON CONFLICT (name) DO NOTHING;
+
+-- name: AddChirpTags :exec
+INSERT INTO chirp_tags (chirp_id, tag_id, created_at)
+SELECT sqlc.arg('chirp_id'), tags.id, sqlc.arg('created_at')
+FROM tags
+WHERE tags.name = ANY(sqlc.arg('names')::text[])
+ON CONFLICT (chirp_id, tag_id) DO NOTHING;
+
+-- name: DeleteChirpTags :exec
+DELETE FROM chirp_tags
+WHERE chirp_id = $1;
+
+-- name: ListTagChirpsAfter :many
+SELECT chirps.* FROM chirps
+INNER JOIN chirp_tags ON chirp_tags.chirp_id = chirps.id
+INNER JOIN tags ON tags.id = chirp_tags.tag_id
+WHERE tags.name = sqlc.arg('tag')
+AND chirps.deleted_at IS NULL
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (chirp_tags.created_at, chirps.id) > (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY chirp_tags.created_at ASC, chirps.id ASC
+LIMIT sqlc.arg('page_limit');
+
+-- name: ListTagChirpsBefore :many
+SELECT chirps.* FROM chirps
+INNER JOIN chirp_tags ON chirp_tags.chirp_id = chirps.id
+INNER JOIN tags ON tags.id = chirp_tags.tag_id
+WHERE tags.name = sqlc.arg('tag')
+AND chirps.deleted_at IS NULL
+AND (
+    sqlc.narg('cursor_created_at')::timestamp IS NULL
+    OR (chirp_tags.created_at, chirps.id) < (sqlc.narg('cursor_created_at')::timestamp, sqlc.narg('cursor_id')::uuid)
+)
+ORDER BY chirp_tags.created_at DESC, chirps.id DESC
+LIMIT sqlc.arg('page_limit');
+
+-- name: GetTrendingTags :many
+-- every use of a tag inside the window counts for 1 when it is brand new and loses half its weight every half-life
+SELECT
+    tags.name,
+    COUNT(*) AS chirp_count,
+    SUM(EXP(-LN(2) * EXTRACT(EPOCH FROM (NOW() - chirp_tags.created_at)) / sqlc.arg('half_life_seconds')::float8))::float8 AS score
+FROM chirp_tags
+INNER JOIN tags ON tags.id = chirp_tags.tag_id
+WHERE chirp_tags.created_at > NOW() - make_interval(secs => sqlc.arg('window_seconds')::float8)
+GROUP BY tags.name
+ORDER BY score DESC, tags.name ASC
+LIMIT sqlc.arg('tag_limit');
@@ -0,0 +1,54 @@
+-- name: SetTOTPSecret :exec
+UPDATE users
+SET totp_secret = $2, updated_at = NOW()
+WHERE id = $1 AND NOT totp_enabled;
+
+-- name: EnableTOTP :execrows
+UPDATE users
+SET totp_enabled = true, totp_last_step = $2, updated_at = NOW()
+WHERE id = $1 AND totp_secret IS NOT NULL AND NOT totp_enabled;
+
+-- name: DisableTOTP :exec
+UPDATE users
+SET totp_enabled = false, totp_secret = NULL, totp_last_step = 0, updated_at = NOW()
+WHERE id = $1;
+
+-- name: UseTOTPStep :execrows
+-- refuses a period that isn't newer than the last one used, so two requests can't both use the same code
+UPDATE users
+SET totp_last_step = sqlc.arg('step')
+WHERE id = sqlc.arg('id') AND totp_last_step < sqlc.arg('step');
+
+-- name: CreateRecoveryCodes :exec
+INSERT INTO recovery_codes (code_hash, user_id, created_at)
+SELECT code_hash, sqlc.arg('user_id'), NOW()
+FROM unnest(sqlc.arg('code_hashes')::text[]) AS code_hash;
+
+-- name: DeleteRecoveryCodes :exec
+DELETE FROM recovery_codes
+WHERE user_id = $1;
+
+-- name: UseRecoveryCode :execrows
+UPDATE recovery_codes
+SET used_at = NOW()
+WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;
+
+-- name: CreateTwoFactorChallenge :exec
+INSERT INTO two_factor_challenges (token_hash, user_id, created_at, expires_at)
+VALUES (
+    $1,
+    $2,
+    NOW(),
+    $3
+);
+
+-- name: UseTwoFactorChallengeAttempt :one
+-- counts the attempt before the code is checked, so parallel guesses can't get past the limit
+UPDATE two_factor_challenges
+SET attempts = attempts + 1
+WHERE token_hash = sqlc.arg('token_hash') AND expires_at > NOW() AND attempts < sqlc.arg('max_attempts')
+RETURNING user_id;
+
+-- name: DeleteTwoFactorChallenge :exec
+DELETE FROM two_factor_challenges
+WHERE token_hash = $1;
\ No newline at end of file
@@ -1,12 +1,13 @@
 -- name: CreateUser :one
-INSERT INTO users (id, created_at, updated_at, email, hashed_password)
-VALUES (
-    gen_random_uuid(),
+INSERT INTO users (id, created_at, updated_at, email, hashed_password, handle)
+SELECT
+    new_user.id,
     NOW(),
     NOW(),
-    $1,
-    $2
-)
+    sqlc.arg('email'),
+    sqlc.arg('hashed_password'),
+    COALESCE(sqlc.narg('handle'), 'user_' || substr(replace(new_user.id::text, '-', ''), 1, 12))
+FROM (SELECT gen_random_uuid() AS id) AS new_user
 RETURNING *;
 
 -- name: DeleteAllUsers :exec
@@ -20,17 +21,48 @@ WHERE email = $1;
 SELECT users.*, refresh_tokens.*
 FROM users
 INNER JOIN refresh_tokens ON users.id = refresh_tokens.user_id
-WHERE refresh_tokens.token = $1
+WHERE refresh_tokens.token_hash = $1
 LIMIT 1;
 
 -- name: UpdateUserInfo :one
 UPDATE users
-SET email = $1, hashed_password = $2, updated_at = NOW()
-WHERE id = $3
+SET email = sqlc.arg('email'), hashed_password = sqlc.arg('hashed_password'), handle = COALESCE(sqlc.narg('handle'), handle),
+    -- a new address has to be verified again
+    email_verified = email_verified AND email = sqlc.arg('email'),
+    updated_at = NOW()
+WHERE id = sqlc.arg('id')
 RETURNING *;
 
 -- name: UpgradeUserTOChirpyRed :one
 UPDATE users
 SET is_chirpy_red = true, updated_at = NOW()
 WHERE id = $1
-RETURNING *;
\ No newline at end of file
+RETURNING *;
+
+-- name: GetUserById :one
+SELECT * FROM users
+WHERE id = $1;
+
+-- name: GetUserByHandle :one
+SELECT * FROM users
+WHERE handle = $1;
+
+-- name: SetEmailVerificationNonce :exec
+UPDATE users
+SET email_verification_nonce = $2
+WHERE id = $1;
+
+-- name: VerifyUserEmail :execrows
+UPDATE users
+SET email_verified = true, email_verification_nonce = NULL, updated_at = NOW()
+WHERE id = sqlc.arg('id') AND email = sqlc.arg('email') AND email_verification_nonce = sqlc.arg('nonce');
+
+-- name: UpdateUserPassword :exec
+UPDATE users
+SET hashed_password = $2, updated_at = NOW()
+WHERE id = $1;
+
+-- name: RehashUserPassword :exec
+UPDATE users
+SET hashed_password = sqlc.arg('new_hash')
+WHERE id = sqlc.arg('id') AND hashed_password = sqlc.arg('old_hash');
\ No newline at end of file
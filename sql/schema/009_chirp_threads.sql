@@ -0,0 +1,30 @@
+-- +goose Up
+ALTER TABLE chirps
+ADD COLUMN in_reply_to UUID,
+ADD CONSTRAINT fk_chirps_in_reply_to
+FOREIGN KEY (in_reply_to)
+REFERENCES chirps(id)
+ON DELETE SET NULL;
+
+ALTER TABLE chirps
+ADD COLUMN root_id UUID;
+
+UPDATE chirps SET root_id = id;
+
+ALTER TABLE chirps
+ALTER COLUMN root_id SET NOT NULL;
+
+ALTER TABLE chirps
+ADD COLUMN deleted_at TIMESTAMP;
+
+CREATE INDEX idx_chirps_in_reply_to ON chirps (in_reply_to);
+CREATE INDEX idx_chirps_root_id ON chirps (root_id);
+
+-- +goose Down
+DROP INDEX idx_chirps_root_id;
+DROP INDEX idx_chirps_in_reply_to;
+
+ALTER TABLE chirps
+DROP COLUMN deleted_at,
+DROP COLUMN root_id,
+DROP COLUMN in_reply_to;
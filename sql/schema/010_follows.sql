@@ -0,0 +1,22 @@
+-- +goose Up
+CREATE TABLE follows (
+    follower_id UUID NOT NULL,
+    CONSTRAINT fk_follows_follower
+    FOREIGN KEY (follower_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    followee_id UUID NOT NULL,
+    CONSTRAINT fk_follows_followee
+    FOREIGN KEY (followee_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (follower_id, followee_id),
+    CONSTRAINT chk_follows_not_self CHECK (follower_id <> followee_id)
+);
+
+CREATE INDEX idx_follows_followee_id ON follows (followee_id, created_at);
+CREATE INDEX idx_follows_follower_id_created_at ON follows (follower_id, created_at);
+
+-- +goose Down
+DROP TABLE follows;
@@ -0,0 +1,21 @@
+-- +goose Up
+CREATE TABLE likes (
+    user_id UUID NOT NULL,
+    CONSTRAINT fk_likes_users
+    FOREIGN KEY (user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    chirp_id UUID NOT NULL,
+    CONSTRAINT fk_likes_chirps
+    FOREIGN KEY (chirp_id)
+    REFERENCES chirps(id)
+    ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    CONSTRAINT uq_likes_user_chirp UNIQUE (user_id, chirp_id)
+);
+
+CREATE INDEX idx_likes_chirp_id ON likes (chirp_id);
+CREATE INDEX idx_likes_user_id_created_at ON likes (user_id, created_at);
+
+-- +goose Down
+DROP TABLE likes;
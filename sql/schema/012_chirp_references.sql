@@ -0,0 +1,21 @@
+-- +goose Up
+-- no foreign keys on purpose: a quote must still know what it quoted after the original is deleted
+ALTER TABLE chirps
+ADD COLUMN rechirp_of UUID,
+ADD COLUMN quote_of UUID,
+ADD CONSTRAINT chk_chirps_single_reference CHECK (rechirp_of IS NULL OR quote_of IS NULL);
+
+CREATE UNIQUE INDEX uq_chirps_user_rechirp ON chirps (user_id, rechirp_of)
+WHERE rechirp_of IS NOT NULL AND deleted_at IS NULL;
+CREATE INDEX idx_chirps_rechirp_of ON chirps (rechirp_of);
+CREATE INDEX idx_chirps_quote_of ON chirps (quote_of);
+
+-- +goose Down
+DROP INDEX idx_chirps_quote_of;
+DROP INDEX idx_chirps_rechirp_of;
+DROP INDEX uq_chirps_user_rechirp;
+
+ALTER TABLE chirps
+DROP CONSTRAINT chk_chirps_single_reference,
+DROP COLUMN quote_of,
+DROP COLUMN rechirp_of;
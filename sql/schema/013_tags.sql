@@ -0,0 +1,29 @@
+-- +goose Up
+CREATE TABLE tags (
+    id UUID PRIMARY KEY,
+    name TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE chirp_tags (
+    chirp_id UUID NOT NULL,
+    CONSTRAINT fk_chirp_tags_chirps
+    FOREIGN KEY (chirp_id)
+    REFERENCES chirps(id)
+    ON DELETE CASCADE,
+    tag_id UUID NOT NULL,
+    CONSTRAINT fk_chirp_tags_tags
+    FOREIGN KEY (tag_id)
+    REFERENCES tags(id)
+    ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (chirp_id, tag_id)
+);
+
+-- tag pages walk one tag's chirps in time order, trending only reads the most recent rows
+CREATE INDEX idx_chirp_tags_tag_id_created_at ON chirp_tags (tag_id, created_at, chirp_id);
+CREATE INDEX idx_chirp_tags_created_at ON chirp_tags (created_at);
+
+-- +goose Down
+DROP TABLE chirp_tags;
+DROP TABLE tags;
@@ -0,0 +1,15 @@
+-- +goose Up
+ALTER TABLE users
+ADD COLUMN handle TEXT;
+
+-- existing users get a placeholder handle they can change with PUT /api/users
+UPDATE users
+SET handle = 'user_' || substr(replace(id::text, '-', ''), 1, 12);
+
+ALTER TABLE users
+ALTER COLUMN handle SET NOT NULL,
+ADD CONSTRAINT uq_users_handle UNIQUE (handle);
+
+-- +goose Down
+ALTER TABLE users
+DROP COLUMN handle;
@@ -0,0 +1,20 @@
+-- +goose Up
+CREATE TABLE mentions (
+    chirp_id UUID NOT NULL,
+    CONSTRAINT fk_mentions_chirps
+    FOREIGN KEY (chirp_id)
+    REFERENCES chirps(id)
+    ON DELETE CASCADE,
+    user_id UUID NOT NULL,
+    CONSTRAINT fk_mentions_users
+    FOREIGN KEY (user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (chirp_id, user_id)
+);
+
+CREATE INDEX idx_mentions_user_id_created_at ON mentions (user_id, created_at);
+
+-- +goose Down
+DROP TABLE mentions;
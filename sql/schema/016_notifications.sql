@@ -0,0 +1,30 @@
+-- +goose Up
+CREATE TABLE notifications (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL,
+    CONSTRAINT fk_notifications_users
+    FOREIGN KEY (user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    CONSTRAINT chk_notifications_kind CHECK (kind IN ('like', 'reply', 'follow', 'mention', 'chirpy_red')),
+    -- the user who caused the notification, NULL for notifications sent by Chirpy itself
+    actor_id UUID,
+    CONSTRAINT fk_notifications_actors
+    FOREIGN KEY (actor_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    chirp_id UUID,
+    CONSTRAINT fk_notifications_chirps
+    FOREIGN KEY (chirp_id)
+    REFERENCES chirps(id)
+    ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    read_at TIMESTAMP
+);
+
+CREATE INDEX idx_notifications_user_id_created_at ON notifications (user_id, created_at, id);
+CREATE INDEX idx_notifications_unread ON notifications (user_id) WHERE read_at IS NULL;
+
+-- +goose Down
+DROP TABLE notifications;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- refresh tokens are now stored as an HMAC of the token, keyed with a secret the database never sees.
+-- The existing rows hold plaintext tokens that can't be hashed from SQL, so they are dropped: everybody has to log in again.
+DELETE FROM refresh_tokens;
+ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash;
+
+-- +goose Down
+DELETE FROM refresh_tokens;
+ALTER TABLE refresh_tokens RENAME COLUMN token_hash TO token;
@@ -0,0 +1,31 @@
+-- +goose Up
+-- a session is one login: the family of refresh tokens it started shares the session's id
+CREATE TABLE sessions (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL,
+    CONSTRAINT fk_sessions_users
+    FOREIGN KEY (user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP NOT NULL,
+    user_agent TEXT NOT NULL,
+    ip_address TEXT NOT NULL
+);
+
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+
+-- families created before this migration didn't record where they came from
+INSERT INTO sessions (id, user_id, created_at, last_used_at, user_agent, ip_address)
+SELECT family_id, user_id, MIN(created_at), MAX(created_at), '', ''
+FROM refresh_tokens
+GROUP BY family_id, user_id;
+
+ALTER TABLE refresh_tokens ADD CONSTRAINT fk_refresh_tokens_sessions
+FOREIGN KEY (family_id)
+REFERENCES sessions(id)
+ON DELETE CASCADE;
+
+-- +goose Down
+ALTER TABLE refresh_tokens DROP CONSTRAINT fk_refresh_tokens_sessions;
+DROP TABLE sessions;
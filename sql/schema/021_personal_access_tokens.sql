@@ -0,0 +1,24 @@
+-- +goose Up
+CREATE TABLE personal_access_tokens (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL,
+    CONSTRAINT fk_personal_access_tokens_users
+    FOREIGN KEY (user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    -- HMAC of the token, like refresh_tokens.token_hash
+    token_hash TEXT NOT NULL,
+    CONSTRAINT uq_personal_access_tokens_token_hash UNIQUE (token_hash),
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    -- NULL for tokens that never expire
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX idx_personal_access_tokens_user_id ON personal_access_tokens (user_id);
+
+-- +goose Down
+DROP TABLE personal_access_tokens;
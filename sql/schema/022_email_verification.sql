@@ -0,0 +1,13 @@
+-- +goose Up
+ALTER TABLE users
+ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT false,
+-- jti of the last verification link sent; a link only works while it's still the latest one, and only once
+ADD COLUMN email_verification_nonce UUID;
+
+-- users from before verification existed count as verified, or turning REQUIRE_VERIFIED_EMAIL on would stop them all from posting
+UPDATE users SET email_verified = true;
+
+-- +goose Down
+ALTER TABLE users
+DROP COLUMN email_verification_nonce,
+DROP COLUMN email_verified;
@@ -0,0 +1,18 @@
+-- +goose Up
+CREATE TABLE password_reset_tokens (
+    -- HMAC of the token, like refresh_tokens.token_hash
+    token_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL,
+    CONSTRAINT fk_password_reset_tokens_users
+    FOREIGN KEY (user_id)
+    REFERENCES users(id)
+    ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX idx_password_reset_tokens_user_id ON password_reset_tokens (user_id);
+
+-- +goose Down
+DROP TABLE password_reset_tokens;
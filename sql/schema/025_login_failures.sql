@@ -0,0 +1,12 @@
+-- +goose Up
+-- failed logins, kept in the database so every server instance applies the same lockouts
+CREATE TABLE login_failures (
+    -- what failed: "email:<address>" for an account, "ip:<address>" for a client
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failed_at TIMESTAMP NOT NULL,
+    locked_until TIMESTAMP
+);
+
+-- +goose Down
+DROP TABLE login_failures;
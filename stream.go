@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const CHIRP_EVENT_CREATED = "chirp.created"
+const CHIRP_EVENT_DELETED = "chirp.deleted"
+
+const STREAM_HISTORY_SIZE = 1000
+const STREAM_SUBSCRIBER_BUFFER_SIZE = 64
+const STREAM_HEARTBEAT_INTERVAL = 15 * time.Second
+
+type chirpEvent struct {
+	ID       uint64
+	Type     string
+	AuthorID uuid.UUID
+	RootID   uuid.UUID
+	Data     []byte
+}
+
+type deletedChirpEvent struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	RootID string `json:"root_id"`
+}
+
+type chirpSubscriber struct {
+	author_id uuid.NullUUID
+	events    chan chirpEvent
+}
+
+// chirpBroadcaster fans chirp events out to every connected stream.
+// It keeps the last STREAM_HISTORY_SIZE events so a client that reconnects with Last-Event-ID gets what it missed.
+// A subscriber whose buffer is full is disconnected instead of making Publish wait; it catches up from the history when it reconnects.
+type chirpBroadcaster struct {
+	mu          sync.Mutex
+	last_id     uint64
+	history     []chirpEvent
+	subscribers map[*chirpSubscriber]struct{}
+}
+
+func newChirpBroadcaster() *chirpBroadcaster {
+	return &chirpBroadcaster{
+		// ids start from the boot time, so ids handed out before a restart are always older than the new ones
+		last_id:     uint64(time.Now().UnixMicro()),
+		subscribers: map[*chirpSubscriber]struct{}{},
+	}
+}
+
+func (b *chirpBroadcaster) Publish(event_type string, author_id uuid.UUID, root_id uuid.UUID, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.last_id++
+	event := chirpEvent{
+		ID:       b.last_id,
+		Type:     event_type,
+		AuthorID: author_id,
+		RootID:   root_id,
+		Data:     data,
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > STREAM_HISTORY_SIZE {
+		b.history = b.history[len(b.history)-STREAM_HISTORY_SIZE:]
+	}
+
+	for subscriber := range b.subscribers {
+		if !subscriber.wants(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			delete(b.subscribers, subscriber)
+			close(subscriber.events)
+		}
+	}
+
+	return nil
+}
+
+// Subscribe registers a new stream and returns the events after last_event_id it has missed.
+// Both happen under the same lock, so no event can fall between the backlog and the live feed.
+func (b *chirpBroadcaster) Subscribe(author_id uuid.NullUUID, last_event_id uint64) (*chirpSubscriber, []chirpEvent) {
+	subscriber := &chirpSubscriber{
+		author_id: author_id,
+		events:    make(chan chirpEvent, STREAM_SUBSCRIBER_BUFFER_SIZE),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	backlog := []chirpEvent{}
+	if last_event_id != 0 {
+		for _, event := range b.history {
+			if event.ID > last_event_id && subscriber.wants(event) {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	b.subscribers[subscriber] = struct{}{}
+	return subscriber, backlog
+}
+
+func (b *chirpBroadcaster) Unsubscribe(subscriber *chirpSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[subscriber]; ok {
+		delete(b.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+func (s *chirpSubscriber) wants(event chirpEvent) bool {
+	return !s.author_id.Valid || s.author_id.UUID == event.AuthorID
+}
+
+func (cfg *apiConfig) handleChirpStream(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	flusher, ok := response_writer.(http.Flusher)
+	if !ok {
+		errorResBody.Error = "Streaming is not supported"
+		jsonResBody, err := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err, 500)
+		return
+	}
+
+	author_uuid := uuid.NullUUID{}
+	author_id := req.URL.Query().Get("author_id")
+	if author_id != "" {
+		parsed_author_id, err2 := uuid.Parse(author_id)
+		if err2 != nil {
+			errorResBody.Error = "Invalid UUID: " + err2.Error()
+			jsonResBody, err3 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err3, 400)
+			return
+		}
+		author_uuid = uuid.NullUUID{UUID: parsed_author_id, Valid: true}
+	}
+
+	last_event_id := uint64(0)
+	if last_event_id_string := req.Header.Get("Last-Event-ID"); last_event_id_string != "" {
+		parsed_last_event_id, err4 := strconv.ParseUint(last_event_id_string, 10, 64)
+		if err4 != nil {
+			errorResBody.Error = "Invalid Last-Event-ID: " + err4.Error()
+			jsonResBody, err5 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err5, 400)
+			return
+		}
+		last_event_id = parsed_last_event_id
+	}
+
+	subscriber, backlog := cfg.ChirpStream.Subscribe(author_uuid, last_event_id)
+	defer cfg.ChirpStream.Unsubscribe(subscriber)
+
+	response_writer.Header().Set("Content-Type", "text/event-stream")
+	response_writer.Header().Set("Cache-Control", "no-cache")
+	response_writer.Header().Set("Connection", "keep-alive")
+	response_writer.WriteHeader(200)
+
+	for _, event := range backlog {
+		writeChirpEvent(response_writer, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(STREAM_HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case event, open := <-subscriber.events:
+			// the broadcaster gave up on this client; it resumes from Last-Event-ID when it reconnects
+			if !open {
+				return
+			}
+			writeChirpEvent(response_writer, event)
+			flusher.Flush()
+		case <-heartbeat.C:
+			// comment lines keep proxies from closing an idle connection
+			fmt.Fprint(response_writer, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeChirpEvent(response_writer http.ResponseWriter, event chirpEvent) {
+	fmt.Fprintf(response_writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+}
+
+// publishChirpCreated and publishChirpDeleted feed the chirp stream once a change is committed.
+// A failure only costs the stream an event, so it's logged and the request carries on.
+// Every subscriber gets the same event, so the viewer_* fields of the author's response are cleared from it.
+func (cfg *apiConfig) publishChirpCreated(chirp Chirp) {
+	author_id, _ := uuid.Parse(chirp.UserID)
+	root_id, _ := uuid.Parse(chirp.RootID)
+	if err := cfg.ChirpStream.Publish(CHIRP_EVENT_CREATED, author_id, root_id, withoutViewerState(chirp)); err != nil {
+		log.Printf("Error while publishing chirp %s to the stream: %v", chirp.ID, err)
+	}
+}
+
+// withoutViewerState copies the chirp, embedded chirps included, as anybody would see it: counts but no viewer_* flags.
+func withoutViewerState(chirp Chirp) Chirp {
+	chirp.ViewerLiked = false
+	chirp.ViewerRechirped = false
+	chirp.RechirpedChirp = referenceWithoutViewerState(chirp.RechirpedChirp)
+	chirp.QuotedChirp = referenceWithoutViewerState(chirp.QuotedChirp)
+	return chirp
+}
+
+func referenceWithoutViewerState(reference *referencedChirp) *referencedChirp {
+	if reference == nil || reference.Chirp == nil {
+		return reference
+	}
+	embedded := withoutViewerState(*reference.Chirp)
+	return &referencedChirp{Chirp: &embedded, ID: reference.ID, Unavailable: reference.Unavailable}
+}
+
+func (cfg *apiConfig) publishChirpDeleted(chirp_id uuid.UUID, author_id uuid.UUID, root_id uuid.UUID) {
+	payload := deletedChirpEvent{
+		ID:     chirp_id.String(),
+		UserID: author_id.String(),
+		RootID: root_id.String(),
+	}
+	if err := cfg.ChirpStream.Publish(CHIRP_EVENT_DELETED, author_id, root_id, payload); err != nil {
+		log.Printf("Error while publishing chirp %s deletion to the stream: %v", chirp_id, err)
+	}
+}
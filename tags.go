@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+const MAX_TAG_LENGTH = 64
+
+const DEFAULT_TRENDING_WINDOW_HOURS = 24
+const MAX_TRENDING_WINDOW_HOURS = 7 * 24
+const DEFAULT_TRENDING_LIMIT = 10
+const MAX_TRENDING_LIMIT = 50
+
+const REINDEX_TAGS_PAGE_SIZE = 500
+
+// a hashtag starts at the beginning of the chirp or after anything that can't be part of a word,
+// so "email#tag" and "C#" don't count
+var hashtagRegexp = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])#([\p{L}\p{N}_]+)`)
+
+type reindexTagsResponseBody struct {
+	Chirps int `json:"chirps"`
+}
+
+type trendingTag struct {
+	Tag        string  `json:"tag"`
+	ChirpCount int64   `json:"chirp_count"`
+	Score      float64 `json:"score"`
+}
+
+// normalizeTag lowercases a tag and drops its leading #, returning false when what's left isn't a valid tag.
+// Tags need at least one letter, so numbers like #1 are left alone.
+func normalizeTag(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimPrefix(tag, "#"))
+	if tag == "" || len(tag) > MAX_TAG_LENGTH {
+		return "", false
+	}
+
+	has_letter := false
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return "", false
+		}
+		if unicode.IsLetter(r) {
+			has_letter = true
+		}
+	}
+
+	return tag, has_letter
+}
+
+// extractHashtags returns the distinct normalized hashtags of a chirp body, in the order they first appear.
+func extractHashtags(body string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+
+	for _, match := range hashtagRegexp.FindAllStringSubmatch(body, -1) {
+		tag, ok := normalizeTag(match[1])
+		if !ok || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+// saveChirpTags replaces the tags indexed for a chirp with the hashtags of its current body.
+// The index rows keep the chirp's creation time, so editing an old chirp doesn't make its tags trend again.
+func saveChirpTags(ctx context.Context, queries *database.Queries, chirp database.Chirp) error {
+	if err := queries.DeleteChirpTags(ctx, chirp.ID); err != nil {
+		return err
+	}
+
+	tags := extractHashtags(chirp.Body)
+	if len(tags) == 0 {
+		return nil
+	}
+
+	if err := queries.CreateTags(ctx, tags); err != nil {
+		return err
+	}
+
+	return queries.AddChirpTags(ctx, database.AddChirpTagsParams{
+		ChirpID:   chirp.ID,
+		CreatedAt: chirp.CreatedAt,
+		Names:     tags,
+	})
+}
+
+func (cfg *apiConfig) handleGetTagChirps(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	tag, ok := normalizeTag(req.PathValue("tag"))
+	if !ok {
+		errorResBody.Error = "Invalid tag"
+		jsonResBody, err := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err, 400)
+		return
+	}
+
+	page_params, err2 := parsePageParams(req.URL.Query(), "desc")
+	if err2 != nil {
+		errorResBody.Error = err2.Error()
+		jsonResBody, err3 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err3, 400)
+		return
+	}
+
+	fetch := func(ascending bool, c *cursor, limit int32) ([]database.Chirp, error) {
+		cursor_created_at, cursor_id := cursorPosition(c)
+		if ascending {
+			return cfg.DBQueries.ListTagChirpsAfter(req.Context(), database.ListTagChirpsAfterParams{
+				Tag:             tag,
+				CursorCreatedAt: cursor_created_at,
+				CursorID:        cursor_id,
+				PageLimit:       limit,
+			})
+		}
+		return cfg.DBQueries.ListTagChirpsBefore(req.Context(), database.ListTagChirpsBeforeParams{
+			Tag:             tag,
+			CursorCreatedAt: cursor_created_at,
+			CursorID:        cursor_id,
+			PageLimit:       limit,
+		})
+	}
+	position := func(chirp database.Chirp) (time.Time, uuid.UUID) {
+		return chirp.CreatedAt, chirp.ID
+	}
+
+	chirps, next_cursor, prev_cursor, err4 := paginate(page_params, fetch, position)
+	if err4 != nil {
+		errorResBody.Error = "Error while fetching tagged chirps from database: " + err4.Error()
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 500)
+		return
+	}
+
+	successResBody := []Chirp{}
+
+	for _, chirp := range chirps {
+		successResBody = append(successResBody, newChirpResponse(chirp))
+	}
+
+	if err6 := cfg.decorateChirps(req.Context(), successResBody, viewerID(req)); err6 != nil {
+		errorResBody.Error = "Error while fetching chirp details from database: " + err6.Error()
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 500)
+		return
+	}
+
+	setPaginationLinks(response_writer, req, next_cursor, prev_cursor)
+	jsonResBody, err8 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err8, 200)
+}
+
+// handleGetTrendingTags ranks the tags used inside the window (the last `window` hours).
+// Each use is weighted by how recent it is, halving every quarter of the window,
+// so a burst of use right now beats a steady trickle over the whole window.
+func (cfg *apiConfig) handleGetTrendingTags(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	window_hours := DEFAULT_TRENDING_WINDOW_HOURS
+	if window_string := req.URL.Query().Get("window"); window_string != "" {
+		parsed_window, err := strconv.Atoi(window_string)
+		if err != nil || parsed_window < 1 || parsed_window > MAX_TRENDING_WINDOW_HOURS {
+			errorResBody.Error = "window must be a number of hours between 1 and " + strconv.Itoa(MAX_TRENDING_WINDOW_HOURS)
+			jsonResBody, err2 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err2, 400)
+			return
+		}
+		window_hours = parsed_window
+	}
+
+	limit := DEFAULT_TRENDING_LIMIT
+	if limit_string := req.URL.Query().Get("limit"); limit_string != "" {
+		parsed_limit, err3 := strconv.Atoi(limit_string)
+		if err3 != nil || parsed_limit < 1 || parsed_limit > MAX_TRENDING_LIMIT {
+			errorResBody.Error = "limit must be a number between 1 and " + strconv.Itoa(MAX_TRENDING_LIMIT)
+			jsonResBody, err4 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err4, 400)
+			return
+		}
+		limit = parsed_limit
+	}
+
+	window := time.Duration(window_hours) * time.Hour
+
+	rows, err5 := cfg.DBQueries.GetTrendingTags(req.Context(), database.GetTrendingTagsParams{
+		HalfLifeSeconds: (window / 4).Seconds(),
+		WindowSeconds:   window.Seconds(),
+		TagLimit:        int32(limit),
+	})
+	if err5 != nil {
+		errorResBody.Error = "Error while fetching trending tags from database: " + err5.Error()
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 500)
+		return
+	}
+
+	successResBody := []trendingTag{}
+
+	for _, row := range rows {
+		successResBody = append(successResBody, trendingTag{
+			Tag:        row.Name,
+			ChirpCount: row.ChirpCount,
+			Score:      row.Score,
+		})
+	}
+
+	jsonResBody, err7 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err7, 200)
+}
+
+// reindexChirpTags saves the tags of one chirp again, with the chirp locked so an edit can't slip in between.
+func (cfg *apiConfig) reindexChirpTags(ctx context.Context, chirp_id uuid.UUID) error {
+	tx, err := cfg.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	queries := cfg.DBQueries.WithTx(tx)
+
+	chirp, err2 := queries.GetChirpByIdForUpdate(ctx, chirp_id)
+	if errors.Is(err2, sql.ErrNoRows) {
+		return nil
+	}
+	if err2 != nil {
+		return err2
+	}
+	if chirp.DeletedAt.Valid {
+		return nil
+	}
+
+	if err3 := saveChirpTags(ctx, queries, chirp); err3 != nil {
+		return err3
+	}
+	return tx.Commit()
+}
+
+// handleReindexTags rebuilds the tag index from the bodies of every chirp. Chirps only get tags when they are
+// written, so this is how the ones from before tags existed get theirs. Running it again does no harm.
+func (cfg *apiConfig) handleReindexTags(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	reindexed := 0
+	var after *cursor
+	for {
+		cursor_created_at, cursor_id := cursorPosition(after)
+		chirps, err := cfg.DBQueries.ListChirpsAfter(req.Context(), database.ListChirpsAfterParams{
+			CursorCreatedAt: cursor_created_at,
+			CursorID:        cursor_id,
+			PageLimit:       REINDEX_TAGS_PAGE_SIZE,
+		})
+		if err != nil {
+			errorResBody.Error = "Error while fetching chirps from database: " + err.Error()
+			jsonResBody, err2 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err2, 500)
+			return
+		}
+
+		for _, chirp := range chirps {
+			if err3 := cfg.reindexChirpTags(req.Context(), chirp.ID); err3 != nil {
+				errorResBody.Error = "Error while saving tags of chirp " + chirp.ID.String() + ": " + err3.Error()
+				jsonResBody, err4 := json.Marshal(errorResBody)
+				writeJSONResponse(response_writer, jsonResBody, err4, 500)
+				return
+			}
+			reindexed++
+		}
+
+		if len(chirps) < REINDEX_TAGS_PAGE_SIZE {
+			break
+		}
+		last := chirps[len(chirps)-1]
+		after = &cursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+
+	successResBody := reindexTagsResponseBody{
+		Chirps: reindexed,
+	}
+	jsonResBody, err5 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err5, 200)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+type threadNode struct {
+	Chirp
+	Replies []*threadNode `json:"replies"`
+}
+
+type threadResponseBody struct {
+	Ancestors []Chirp     `json:"ancestors"`
+	Chirp     *threadNode `json:"chirp"`
+}
+
+func (cfg *apiConfig) handleGetChirpThread(response_writer http.ResponseWriter, req *http.Request) {
+	chirp_id := req.PathValue("chirpID")
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	parsed_chirp_id, err := uuid.Parse(chirp_id)
+	if err != nil {
+		errorResBody.Error = "Invalid UUID: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	chirp, err3 := cfg.DBQueries.GetChirpById(req.Context(), parsed_chirp_id)
+	if err3 != nil {
+		errorResBody.Error = "Error while fetching chirp with id '" + chirp_id + "' from database: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 404)
+		return
+	}
+
+	ancestors, err5 := cfg.DBQueries.GetChirpAncestors(req.Context(), chirp.ID)
+	if err5 != nil {
+		errorResBody.Error = "Error while fetching chirp ancestors from database: " + err5.Error()
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 500)
+		return
+	}
+
+	descendants, err7 := cfg.DBQueries.GetChirpDescendants(req.Context(), uuid.NullUUID{UUID: chirp.ID, Valid: true})
+	if err7 != nil {
+		errorResBody.Error = "Error while fetching chirp replies from database: " + err7.Error()
+		jsonResBody, err8 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err8, 500)
+		return
+	}
+
+	successResBody := threadResponseBody{
+		Ancestors: []Chirp{},
+		Chirp: &threadNode{
+			Chirp:   newChirpResponse(chirp),
+			Replies: []*threadNode{},
+		},
+	}
+
+	for _, ancestor := range ancestors {
+		successResBody.Ancestors = append(successResBody.Ancestors, newChirpResponse(ancestor.Chirp))
+	}
+
+	// descendants come oldest first, so a reply's parent is always placed before the reply itself
+	nodes := map[uuid.UUID]*threadNode{chirp.ID: successResBody.Chirp}
+	for _, descendant := range descendants {
+		node := &threadNode{
+			Chirp:   newChirpResponse(descendant.Chirp),
+			Replies: []*threadNode{},
+		}
+		nodes[descendant.Chirp.ID] = node
+		if parent, ok := nodes[descendant.Chirp.InReplyTo.UUID]; ok {
+			parent.Replies = append(parent.Replies, node)
+		}
+	}
+
+	// like stats are fetched for the whole thread at once, then copied back into the tree
+	thread_nodes := []*threadNode{}
+	chirps := []Chirp{}
+	for _, node := range nodes {
+		thread_nodes = append(thread_nodes, node)
+		chirps = append(chirps, node.Chirp)
+	}
+	chirps = append(chirps, successResBody.Ancestors...)
+
+	if err9 := cfg.decorateChirps(req.Context(), chirps, viewerID(req)); err9 != nil {
+		errorResBody.Error = "Error while fetching chirp details from database: " + err9.Error()
+		jsonResBody, err10 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err10, 500)
+		return
+	}
+
+	for i, node := range thread_nodes {
+		node.Chirp = chirps[i]
+	}
+	copy(successResBody.Ancestors, chirps[len(thread_nodes):])
+
+	jsonResBody, err11 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err11, 200)
+}
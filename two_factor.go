@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/OmarJarbou/Chirpy/internal/auth"
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/google/uuid"
+)
+
+const TOTP_ISSUER = "Chirpy"
+
+const TWO_FACTOR_CHALLENGE_EXP_TIME = 5 * time.Minute
+
+// MAX_TWO_FACTOR_ATTEMPTS is how many codes can be tried with one challenge; after that the password has to be entered again.
+const MAX_TWO_FACTOR_ATTEMPTS = 5
+
+type enrollTwoFactorRequestBody struct {
+	Password string `json:"password"`
+}
+
+type twoFactorCodeRequestBody struct {
+	Code string `json:"code"`
+}
+
+type disableTwoFactorRequestBody struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type loginTwoFactorRequestBody struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+type enrollTwoFactorResponseBody struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type recoveryCodesResponseBody struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type twoFactorChallengeResponseBody struct {
+	TwoFactorRequired bool      `json:"two_factor_required"`
+	ChallengeToken    string    `json:"challenge_token"`
+	ExpiresAt         time.Time `json:"expires_at"`
+}
+
+// checkSecondFactor accepts either a code of the user's authenticator app or one of their unused recovery codes.
+// Either way the code is used up, so it can't be accepted a second time.
+func (cfg *apiConfig) checkSecondFactor(ctx context.Context, user database.User, code string) (bool, error) {
+	if step, ok := auth.ValidateTOTP(user.TotpSecret.String, code, time.Now(), user.TotpLastStep); ok {
+		rows, err := cfg.DBQueries.UseTOTPStep(ctx, database.UseTOTPStepParams{
+			Step: step,
+			ID:   user.ID,
+		})
+		return rows == 1, err
+	}
+
+	rows, err2 := cfg.DBQueries.UseRecoveryCode(ctx, database.UseRecoveryCodeParams{
+		UserID:   user.ID,
+		CodeHash: auth.HashRecoveryCode(code, cfg.RefreshTokenKey),
+	})
+	return rows == 1, err2
+}
+
+// startTwoFactorChallenge is how handleLogin answers for users with 2FA on: no tokens yet, only a challenge for POST /api/login/2fa.
+func (cfg *apiConfig) startTwoFactorChallenge(response_writer http.ResponseWriter, req *http.Request, user database.User) {
+	errorResBody := errorResponseBody{}
+
+	challenge_token, err := auth.MakeTwoFactorChallengeToken()
+	if err != nil {
+		errorResBody.Error = err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 500)
+		return
+	}
+
+	expires_at := time.Now().Add(TWO_FACTOR_CHALLENGE_EXP_TIME)
+	err3 := cfg.DBQueries.CreateTwoFactorChallenge(req.Context(), database.CreateTwoFactorChallengeParams{
+		TokenHash: auth.HashTwoFactorChallengeToken(challenge_token, cfg.RefreshTokenKey),
+		UserID:    user.ID,
+		ExpiresAt: expires_at,
+	})
+	if err3 != nil {
+		errorResBody.Error = "Error while creating two-factor challenge: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	successResBody := twoFactorChallengeResponseBody{
+		TwoFactorRequired: true,
+		ChallengeToken:    challenge_token,
+		ExpiresAt:         expires_at,
+	}
+	jsonResBody, err5 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err5, 200)
+}
+
+func (cfg *apiConfig) handleLoginTwoFactor(response_writer http.ResponseWriter, req *http.Request) {
+	reqBody := loginTwoFactorRequestBody{}
+	errorResBody := errorResponseBody{}
+
+	if err := json.NewDecoder(req.Body).Decode(&reqBody); err != nil {
+		errorResBody.Error = "Error while decoding request's json " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	challenge_hash := auth.HashTwoFactorChallengeToken(reqBody.ChallengeToken, cfg.RefreshTokenKey)
+	user_id, err3 := cfg.DBQueries.UseTwoFactorChallengeAttempt(req.Context(), database.UseTwoFactorChallengeAttemptParams{
+		TokenHash:   challenge_hash,
+		MaxAttempts: MAX_TWO_FACTOR_ATTEMPTS,
+	})
+	if errors.Is(err3, sql.ErrNoRows) {
+		errorResBody.Error = "Challenge is invalid, expired or out of attempts, log in again"
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 401)
+		return
+	}
+	if err3 != nil {
+		errorResBody.Error = "Error while checking two-factor challenge: " + err3.Error()
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 500)
+		return
+	}
+
+	user, err6 := cfg.DBQueries.GetUserById(req.Context(), user_id)
+	if err6 != nil {
+		errorResBody.Error = "Error while fetching user: " + err6.Error()
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 500)
+		return
+	}
+
+	ok, err8 := cfg.checkSecondFactor(req.Context(), user, reqBody.Code)
+	if err8 != nil {
+		errorResBody.Error = "Error while checking code: " + err8.Error()
+		jsonResBody, err9 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err9, 500)
+		return
+	}
+	if !ok {
+		errorResBody.Error = "Invalid code"
+		jsonResBody, err10 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err10, 401)
+		return
+	}
+
+	if err11 := cfg.DBQueries.DeleteTwoFactorChallenge(req.Context(), challenge_hash); err11 != nil {
+		errorResBody.Error = "Error while deleting two-factor challenge: " + err11.Error()
+		jsonResBody, err12 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err12, 500)
+		return
+	}
+
+	cfg.completeLogin(response_writer, req, user)
+}
+
+// handleEnrollTwoFactor starts enrollment with a new secret. 2FA only turns on once handleConfirmTwoFactor
+// saw a code made from it, so a secret that never made it into an authenticator app can't lock the user out.
+// It needs the password, like handleDisableTwoFactor: otherwise a stolen access token could put the account
+// behind an authenticator app of the thief's.
+func (cfg *apiConfig) handleEnrollTwoFactor(response_writer http.ResponseWriter, req *http.Request) {
+	reqBody := enrollTwoFactorRequestBody{}
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	if err := json.NewDecoder(req.Body).Decode(&reqBody); err != nil {
+		errorResBody.Error = "Error while decoding request's json " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	user, err3 := cfg.DBQueries.GetUserById(req.Context(), user_id)
+	if err3 != nil {
+		errorResBody.Error = "Error while fetching user: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	if user.TotpEnabled {
+		errorResBody.Error = "Two-factor authentication is already on, disable it first"
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 409)
+		return
+	}
+
+	// password guesses here count against the same lockout as logins, or a stolen access token would allow unlimited ones
+	account_key, ip_key := loginFailureKeys(user.Email, req)
+	retry_after, locked_keys, err6 := cfg.startLoginAttempt(req.Context(), account_key, ip_key)
+	if err6 != nil {
+		errorResBody.Error = err6.Error()
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 500)
+		return
+	}
+	if retry_after > 0 {
+		writeLoginLockedResponse(response_writer, retry_after)
+		return
+	}
+
+	if err8 := auth.CheckPasswordHash(reqBody.Password, user.HashedPassword); err8 != nil {
+		errorResBody.Error = err8.Error()
+		jsonResBody, err9 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err9, 401)
+		return
+	}
+
+	if err10 := cfg.finishLoginAttempt(req.Context(), account_key, ip_key, locked_keys); err10 != nil {
+		errorResBody.Error = err10.Error()
+		jsonResBody, err11 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err11, 500)
+		return
+	}
+
+	secret, err12 := auth.GenerateTOTPSecret()
+	if err12 != nil {
+		errorResBody.Error = err12.Error()
+		jsonResBody, err13 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err13, 500)
+		return
+	}
+
+	err14 := cfg.DBQueries.SetTOTPSecret(req.Context(), database.SetTOTPSecretParams{
+		ID:         user.ID,
+		TotpSecret: sql.NullString{String: secret, Valid: true},
+	})
+	if err14 != nil {
+		errorResBody.Error = "Error while saving two-factor secret: " + err14.Error()
+		jsonResBody, err15 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err15, 500)
+		return
+	}
+
+	successResBody := enrollTwoFactorResponseBody{
+		Secret:     secret,
+		OTPAuthURI: auth.TOTPProvisioningURI(secret, TOTP_ISSUER, user.Email),
+	}
+	jsonResBody, err16 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err16, 200)
+}
+
+func (cfg *apiConfig) handleConfirmTwoFactor(response_writer http.ResponseWriter, req *http.Request) {
+	reqBody := twoFactorCodeRequestBody{}
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	if err := json.NewDecoder(req.Body).Decode(&reqBody); err != nil {
+		errorResBody.Error = "Error while decoding request's json " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	user, err3 := cfg.DBQueries.GetUserById(req.Context(), user_id)
+	if err3 != nil {
+		errorResBody.Error = "Error while fetching user: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	if user.TotpEnabled {
+		errorResBody.Error = "Two-factor authentication is already on"
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 409)
+		return
+	}
+	if !user.TotpSecret.Valid {
+		errorResBody.Error = "Start with POST /api/users/2fa/enroll"
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 400)
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(user.TotpSecret.String, reqBody.Code, time.Now(), 0)
+	if !ok {
+		errorResBody.Error = "Invalid code, check the authenticator app was set up with the latest secret"
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 400)
+		return
+	}
+
+	recovery_codes, err8 := auth.MakeRecoveryCodes()
+	if err8 != nil {
+		errorResBody.Error = err8.Error()
+		jsonResBody, err9 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err9, 500)
+		return
+	}
+	code_hashes := []string{}
+	for _, code := range recovery_codes {
+		code_hashes = append(code_hashes, auth.HashRecoveryCode(code, cfg.RefreshTokenKey))
+	}
+
+	tx, err10 := cfg.DB.BeginTx(req.Context(), nil)
+	if err10 != nil {
+		errorResBody.Error = "Error while starting transaction: " + err10.Error()
+		jsonResBody, err11 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err11, 500)
+		return
+	}
+	defer tx.Rollback()
+	queries := cfg.DBQueries.WithTx(tx)
+
+	// the code used to confirm counts as used, so it can't also log in
+	enabled, err12 := queries.EnableTOTP(req.Context(), database.EnableTOTPParams{
+		ID:           user.ID,
+		TotpLastStep: step,
+	})
+	if err12 != nil {
+		errorResBody.Error = "Error while turning two-factor authentication on: " + err12.Error()
+		jsonResBody, err13 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err13, 500)
+		return
+	}
+	if enabled == 0 {
+		errorResBody.Error = "Two-factor authentication is already on"
+		jsonResBody, err14 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err14, 409)
+		return
+	}
+
+	if err15 := queries.DeleteRecoveryCodes(req.Context(), user.ID); err15 != nil {
+		errorResBody.Error = "Error while deleting old recovery codes: " + err15.Error()
+		jsonResBody, err16 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err16, 500)
+		return
+	}
+
+	err17 := queries.CreateRecoveryCodes(req.Context(), database.CreateRecoveryCodesParams{
+		UserID:     user.ID,
+		CodeHashes: code_hashes,
+	})
+	if err17 != nil {
+		errorResBody.Error = "Error while saving recovery codes: " + err17.Error()
+		jsonResBody, err18 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err18, 500)
+		return
+	}
+
+	if err19 := tx.Commit(); err19 != nil {
+		errorResBody.Error = "Error while committing two-factor enrollment: " + err19.Error()
+		jsonResBody, err20 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err20, 500)
+		return
+	}
+
+	successResBody := recoveryCodesResponseBody{
+		RecoveryCodes: recovery_codes,
+	}
+	jsonResBody, err21 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err21, 200)
+}
+
+// handleDisableTwoFactor needs the password and a code, so a stolen access token alone can't turn 2FA off.
+func (cfg *apiConfig) handleDisableTwoFactor(response_writer http.ResponseWriter, req *http.Request) {
+	reqBody := disableTwoFactorRequestBody{}
+	errorResBody := errorResponseBody{}
+
+	user_id := req.Context().Value("user_id").(uuid.UUID)
+
+	if err := json.NewDecoder(req.Body).Decode(&reqBody); err != nil {
+		errorResBody.Error = "Error while decoding request's json " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	user, err3 := cfg.DBQueries.GetUserById(req.Context(), user_id)
+	if err3 != nil {
+		errorResBody.Error = "Error while fetching user: " + err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+
+	if !user.TotpEnabled {
+		errorResBody.Error = "Two-factor authentication is off"
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 409)
+		return
+	}
+
+	// counted like a login, and only taken back once the code is right too, so codes can't be guessed without limit either
+	account_key, ip_key := loginFailureKeys(user.Email, req)
+	retry_after, locked_keys, err6 := cfg.startLoginAttempt(req.Context(), account_key, ip_key)
+	if err6 != nil {
+		errorResBody.Error = err6.Error()
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 500)
+		return
+	}
+	if retry_after > 0 {
+		writeLoginLockedResponse(response_writer, retry_after)
+		return
+	}
+
+	if err8 := auth.CheckPasswordHash(reqBody.Password, user.HashedPassword); err8 != nil {
+		errorResBody.Error = err8.Error()
+		jsonResBody, err9 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err9, 401)
+		return
+	}
+
+	ok, err10 := cfg.checkSecondFactor(req.Context(), user, reqBody.Code)
+	if err10 != nil {
+		errorResBody.Error = "Error while checking code: " + err10.Error()
+		jsonResBody, err11 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err11, 500)
+		return
+	}
+	if !ok {
+		errorResBody.Error = "Invalid code"
+		jsonResBody, err12 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err12, 401)
+		return
+	}
+
+	if err13 := cfg.finishLoginAttempt(req.Context(), account_key, ip_key, locked_keys); err13 != nil {
+		errorResBody.Error = err13.Error()
+		jsonResBody, err14 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err14, 500)
+		return
+	}
+
+	tx, err15 := cfg.DB.BeginTx(req.Context(), nil)
+	if err15 != nil {
+		errorResBody.Error = "Error while starting transaction: " + err15.Error()
+		jsonResBody, err16 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err16, 500)
+		return
+	}
+	defer tx.Rollback()
+	queries := cfg.DBQueries.WithTx(tx)
+
+	if err17 := queries.DisableTOTP(req.Context(), user.ID); err17 != nil {
+		errorResBody.Error = "Error while turning two-factor authentication off: " + err17.Error()
+		jsonResBody, err18 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err18, 500)
+		return
+	}
+
+	if err19 := queries.DeleteRecoveryCodes(req.Context(), user.ID); err19 != nil {
+		errorResBody.Error = "Error while deleting recovery codes: " + err19.Error()
+		jsonResBody, err20 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err20, 500)
+		return
+	}
+
+	if err21 := tx.Commit(); err21 != nil {
+		errorResBody.Error = "Error while committing two-factor removal: " + err21.Error()
+		jsonResBody, err22 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err22, 500)
+		return
+	}
+
+	response_writer.WriteHeader(204)
+}
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/OmarJarbou/Chirpy/internal/auth"
 	"github.com/OmarJarbou/Chirpy/internal/database"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type userRequestBody struct {
 	Password string `json:"password"`
 	Email    string `json:"email"`
+	Handle   string `json:"handle"`
 }
 
 type loginRequestBody struct {
@@ -24,17 +30,29 @@ const DEFAULT_TOKEN_EXP_TIME = 3600
 const DEFAULT_REFRESH_TOKEN_EXP_TIME = 60 * 3600
 
 type userSuccessResponseBody struct {
-	ID           string    `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	Email        string    `json:"email"`
-	IsChirpyRed  bool      `json:"is_chirpy_red"`
-	Token        string    `json:"token"`
-	RefreshToken string    `json:"refresh_token"`
+	ID            string    `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	Handle        string    `json:"handle"`
+	Role          string    `json:"role"`
+	IsChirpyRed   bool      `json:"is_chirpy_red"`
+	Token         string    `json:"token"`
+	RefreshToken  string    `json:"refresh_token"`
+}
+
+// userProfile is what anybody can see about a user; the email address stays private.
+type userProfile struct {
+	ID          string    `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Handle      string    `json:"handle"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
 }
 
 type refreshSuccessResponseBody struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 func (cfg *apiConfig) handleCreateUser(response_writer http.ResponseWriter, req *http.Request) {
@@ -49,33 +67,49 @@ func (cfg *apiConfig) handleCreateUser(response_writer http.ResponseWriter, req
 		return
 	}
 
+	handle := req.Context().Value("handle").(string)
+
 	db_user := database.CreateUserParams{
 		Email:          req.Context().Value("email").(string),
 		HashedPassword: hashed,
+		Handle:         sql.NullString{String: handle, Valid: handle != ""},
 	}
 	user, err3 := cfg.DBQueries.CreateUser(req.Context(), db_user)
+	if isUniqueViolation(err3, "uq_users_handle") {
+		errorResBody.Error = "This handle is already taken"
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 409)
+		return
+	}
 	if err3 != nil {
 		errorResBody.Error = "Error while creating user: " + err3.Error()
-		jsonResBody, err4 := json.Marshal(errorResBody)
-		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		jsonResBody, err5 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err5, 500)
 		return
 	}
 
+	// the account exists either way; a failed email can be sent again through POST /api/users/verify/resend
+	if err6 := cfg.sendEmailVerification(req.Context(), user); err6 != nil {
+		log.Printf("Error while sending verification email to user %s: %v", user.ID, err6)
+	}
+
 	successResBody := userSuccessResponseBody{
-		ID:          user.ID.String(),
-		CreatedAt:   user.CreatedAt,
-		UpdatedAt:   user.UpdatedAt,
-		Email:       user.Email,
-		IsChirpyRed: user.IsChirpyRed,
+		ID:            user.ID.String(),
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Handle:        user.Handle,
+		Role:          user.Role,
+		IsChirpyRed:   user.IsChirpyRed,
 	}
-	jsonResBody, err5 := json.Marshal(successResBody)
-	writeJSONResponse(response_writer, jsonResBody, err5, 201)
+	jsonResBody, err7 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err7, 201)
 }
 
 func (cfg *apiConfig) handleLogin(response_writer http.ResponseWriter, req *http.Request) {
 	reqBody := loginRequestBody{}
 	errorResBody := errorResponseBody{}
-	var jsonResBody []byte
 	if err := json.NewDecoder(req.Body).Decode(&reqBody); err != nil {
 		errorResBody.Error = "Error while decoding request's json " + err.Error()
 		jsonResBody, err2 := json.Marshal(errorResBody)
@@ -84,70 +118,171 @@ func (cfg *apiConfig) handleLogin(response_writer http.ResponseWriter, req *http
 		return
 	}
 
-	user, err3 := cfg.DBQueries.GetUserByEmail(req.Context(), reqBody.Email)
+	account_key, ip_key := loginFailureKeys(reqBody.Email, req)
+	retry_after, locked_keys, err3 := cfg.startLoginAttempt(req.Context(), account_key, ip_key)
 	if err3 != nil {
-		errorResBody.Error = "Error while fetching user by this email: " + err3.Error()
+		errorResBody.Error = err3.Error()
 		jsonResBody, err4 := json.Marshal(errorResBody)
-		writeJSONResponse(response_writer, jsonResBody, err4, 401)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+	if retry_after > 0 {
+		writeLoginLockedResponse(response_writer, retry_after)
 		return
 	}
 
-	err5 := auth.CheckPasswordHash(reqBody.Password, user.HashedPassword)
-	if err5 != nil {
-		errorResBody.Error = err5.Error()
+	user, err5 := cfg.DBQueries.GetUserByEmail(req.Context(), reqBody.Email)
+	if err5 != nil && !errors.Is(err5, sql.ErrNoRows) {
+		errorResBody.Error = "Error while fetching user by this email: " + err5.Error()
 		jsonResBody, err6 := json.Marshal(errorResBody)
-		writeJSONResponse(response_writer, jsonResBody, err6, 401)
+		writeJSONResponse(response_writer, jsonResBody, err6, 500)
 		return
 	}
 
-	duration := time.Duration(DEFAULT_TOKEN_EXP_TIME) * time.Second
-	token, err7 := auth.MakeJWT(user.ID, cfg.ChirpySecretKey, duration)
-	if err7 != nil {
-		errorResBody.Error = err7.Error()
+	// an unknown email and a wrong password look the same: same answer, and a password check either way
+	var err7 error
+	if err5 != nil {
+		auth.SimulatePasswordCheck(reqBody.Password)
+	} else {
+		err7 = auth.CheckPasswordHash(reqBody.Password, user.HashedPassword)
+	}
+	// the failure was already counted by startLoginAttempt
+	if err5 != nil || err7 != nil {
+		errorResBody.Error = "Incorrect email or password"
 		jsonResBody, err8 := json.Marshal(errorResBody)
-		writeJSONResponse(response_writer, jsonResBody, err8, 400)
+		writeJSONResponse(response_writer, jsonResBody, err8, 401)
 		return
 	}
 
-	refreshTokenString, err9 := auth.MakeRefreshToken()
-	if err9 != nil {
+	if err9 := cfg.finishLoginAttempt(req.Context(), account_key, ip_key, locked_keys); err9 != nil {
 		errorResBody.Error = err9.Error()
 		jsonResBody, err10 := json.Marshal(errorResBody)
-		writeJSONResponse(response_writer, jsonResBody, err10, 400)
+		writeJSONResponse(response_writer, jsonResBody, err10, 500)
+		return
+	}
+
+	// bcrypt hashes, and argon2id ones with older parameters, are replaced while the password is at hand;
+	// when that fails the old hash keeps working, and the next login tries again
+	if auth.PasswordNeedsRehash(user.HashedPassword) {
+		cfg.rehashPassword(req.Context(), user, reqBody.Password)
+	}
+
+	if user.TotpEnabled {
+		cfg.startTwoFactorChallenge(response_writer, req, user)
+		return
+	}
+
+	cfg.completeLogin(response_writer, req, user)
+}
+
+// rehashPassword stores a new hash of the password, unless the password changed since the old hash was read.
+func (cfg *apiConfig) rehashPassword(ctx context.Context, user database.User, password string) {
+	hashed, err := auth.HashPassword(password)
+	if err != nil {
+		log.Printf("Error while rehashing password of user %s: %v", user.ID, err)
+		return
+	}
+
+	err2 := cfg.DBQueries.RehashUserPassword(ctx, database.RehashUserPasswordParams{
+		ID:      user.ID,
+		OldHash: user.HashedPassword,
+		NewHash: hashed,
+	})
+	if err2 != nil {
+		log.Printf("Error while saving rehashed password of user %s: %v", user.ID, err2)
+	}
+}
+
+// completeLogin hands out the tokens of a new session, once every credential of the user checked out.
+func (cfg *apiConfig) completeLogin(response_writer http.ResponseWriter, req *http.Request, user database.User) {
+	errorResBody := errorResponseBody{}
+
+	duration := time.Duration(DEFAULT_TOKEN_EXP_TIME) * time.Second
+	token, err := cfg.JWTKeys.MakeJWT(user.ID, user.Role, duration)
+	if err != nil {
+		errorResBody.Error = err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		return
+	}
+
+	refreshTokenString, err3 := auth.MakeRefreshToken()
+	if err3 != nil {
+		errorResBody.Error = err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 400)
+		return
+	}
+
+	// a login starts a new session, and its refresh tokens form the session's family;
+	// both are written together, so a failed login never leaves a session without a refresh token behind
+	tx, err5 := cfg.DB.BeginTx(req.Context(), nil)
+	if err5 != nil {
+		errorResBody.Error = "Error while starting transaction: " + err5.Error()
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 500)
+		return
+	}
+	defer tx.Rollback()
+	queries := cfg.DBQueries.WithTx(tx)
+
+	session, err7 := queries.CreateSession(req.Context(), database.CreateSessionParams{
+		UserID:    user.ID,
+		UserAgent: req.UserAgent(),
+		IpAddress: clientIP(req),
+	})
+	if err7 != nil {
+		errorResBody.Error = "Error while creating new session: " + err7.Error()
+		jsonResBody, err8 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err8, 500)
 		return
 	}
 
 	refresh_token_duration := time.Duration(DEFAULT_REFRESH_TOKEN_EXP_TIME) * time.Second
 	refresh_token_expiration_time := time.Now().Add(refresh_token_duration)
 	createRefreshTokenParams := database.CreateRefreshTokenParams{
-		Token:     refreshTokenString,
+		TokenHash: auth.HashRefreshToken(refreshTokenString, cfg.RefreshTokenKey),
 		UserID:    user.ID,
 		ExpiresAt: refresh_token_expiration_time,
+		FamilyID:  session.ID,
+	}
+
+	_, err9 := queries.CreateRefreshToken(req.Context(), createRefreshTokenParams)
+	if err9 != nil {
+		errorResBody.Error = "Error while creating new refresh token: " + err9.Error()
+		jsonResBody, err10 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err10, 500)
+		return
 	}
 
-	refreshToken, err11 := cfg.DBQueries.CreateRefreshToken(req.Context(), createRefreshTokenParams)
-	if err11 != nil {
-		errorResBody.Error = "Error while creating new refresh token: " + err11.Error()
+	if err11 := tx.Commit(); err11 != nil {
+		errorResBody.Error = "Error while committing new session: " + err11.Error()
 		jsonResBody, err12 := json.Marshal(errorResBody)
-		writeJSONResponse(response_writer, jsonResBody, err12, 400)
+		writeJSONResponse(response_writer, jsonResBody, err12, 500)
 		return
 	}
 
 	successResBody := userSuccessResponseBody{
-		ID:           user.ID.String(),
-		CreatedAt:    user.CreatedAt,
-		UpdatedAt:    user.UpdatedAt,
-		Email:        user.Email,
-		IsChirpyRed:  user.IsChirpyRed,
-		Token:        token,
-		RefreshToken: refreshToken.Token,
+		ID:            user.ID.String(),
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Handle:        user.Handle,
+		Role:          user.Role,
+		IsChirpyRed:   user.IsChirpyRed,
+		Token:         token,
+		RefreshToken:  refreshTokenString,
 	}
 	jsonResBody, err13 := json.Marshal(successResBody)
 	writeJSONResponse(response_writer, jsonResBody, err13, 200)
 }
 
+// handleRefreshToken trades a refresh token for a new access token and a new refresh token of the same family.
+// The old refresh token can't be used again: presenting it a second time means it leaked, so the whole family gets revoked.
 func (cfg *apiConfig) handleRefreshToken(response_writer http.ResponseWriter, req *http.Request) {
 	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
 
 	tokenString, err := auth.GetBearerToken(req.Header)
 	if err != nil {
@@ -157,7 +292,8 @@ func (cfg *apiConfig) handleRefreshToken(response_writer http.ResponseWriter, re
 		return
 	}
 
-	user, err3 := cfg.DBQueries.GetUserFromRefreshToken(req.Context(), tokenString)
+	token_hash := auth.HashRefreshToken(tokenString, cfg.RefreshTokenKey)
+	user, err3 := cfg.DBQueries.GetUserFromRefreshToken(req.Context(), token_hash)
 	if err3 != nil {
 		errorResBody.Error = "Error while fetching user by this token: " + err3.Error()
 		jsonResBody, err4 := json.Marshal(errorResBody)
@@ -165,6 +301,11 @@ func (cfg *apiConfig) handleRefreshToken(response_writer http.ResponseWriter, re
 		return
 	}
 
+	if user.ReplacedBy.Valid {
+		cfg.revokeRefreshTokenFamily(response_writer, req, user.FamilyID)
+		return
+	}
+
 	if user.ExpiresAt.Before(time.Now()) || user.RevokedAt.Valid {
 		errorResBody.Error = "Your refresh token is invalid, (expired or revoked)!"
 		jsonResBody, err5 := json.Marshal(errorResBody)
@@ -173,7 +314,7 @@ func (cfg *apiConfig) handleRefreshToken(response_writer http.ResponseWriter, re
 	}
 
 	duration := time.Duration(DEFAULT_TOKEN_EXP_TIME) * time.Second
-	new_token, err6 := auth.MakeJWT(user.ID, cfg.ChirpySecretKey, duration)
+	new_token, err6 := cfg.JWTKeys.MakeJWT(user.ID, user.Role, duration)
 	if err6 != nil {
 		errorResBody.Error = err6.Error()
 		jsonResBody, err7 := json.Marshal(errorResBody)
@@ -181,12 +322,93 @@ func (cfg *apiConfig) handleRefreshToken(response_writer http.ResponseWriter, re
 		return
 	}
 
+	new_refresh_token_string, err8 := auth.MakeRefreshToken()
+	if err8 != nil {
+		errorResBody.Error = err8.Error()
+		jsonResBody, err9 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err9, 400)
+		return
+	}
+
+	tx, err10 := cfg.DB.BeginTx(req.Context(), nil)
+	if err10 != nil {
+		errorResBody.Error = "Error while starting transaction: " + err10.Error()
+		jsonResBody, err11 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err11, 500)
+		return
+	}
+	defer tx.Rollback()
+	queries := cfg.DBQueries.WithTx(tx)
+
+	refresh_token_duration := time.Duration(DEFAULT_REFRESH_TOKEN_EXP_TIME) * time.Second
+	new_refresh_token, err12 := queries.CreateRefreshToken(req.Context(), database.CreateRefreshTokenParams{
+		TokenHash: auth.HashRefreshToken(new_refresh_token_string, cfg.RefreshTokenKey),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(refresh_token_duration),
+		FamilyID:  user.FamilyID,
+	})
+	if err12 != nil {
+		errorResBody.Error = "Error while creating new refresh token: " + err12.Error()
+		jsonResBody, err13 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err13, 500)
+		return
+	}
+
+	rotated, err14 := queries.RotateRefreshToken(req.Context(), database.RotateRefreshTokenParams{
+		ReplacedBy: sql.NullString{String: new_refresh_token.TokenHash, Valid: true},
+		TokenHash:  token_hash,
+	})
+	if err14 != nil {
+		errorResBody.Error = "Error while revoking user's token: " + err14.Error()
+		jsonResBody, err15 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err15, 500)
+		return
+	}
+	// another request rotated the same token since it was read, so it has been used twice
+	if rotated == 0 {
+		tx.Rollback()
+		cfg.revokeRefreshTokenFamily(response_writer, req, user.FamilyID)
+		return
+	}
+
+	if err16 := queries.TouchSession(req.Context(), user.FamilyID); err16 != nil {
+		errorResBody.Error = "Error while updating session: " + err16.Error()
+		jsonResBody, err17 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err17, 500)
+		return
+	}
+
+	if err18 := tx.Commit(); err18 != nil {
+		errorResBody.Error = "Error while committing refresh token rotation: " + err18.Error()
+		jsonResBody, err19 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err19, 500)
+		return
+	}
+
 	successResBody := refreshSuccessResponseBody{
-		Token: new_token,
+		Token:        new_token,
+		RefreshToken: new_refresh_token_string,
+	}
+
+	jsonResBody, err20 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err20, 200)
+}
+
+// revokeRefreshTokenFamily answers the reuse of an already rotated refresh token by revoking every token of its family, which logs out the session it came from.
+func (cfg *apiConfig) revokeRefreshTokenFamily(response_writer http.ResponseWriter, req *http.Request, family_id uuid.UUID) {
+	errorResBody := errorResponseBody{}
+
+	err := cfg.DBQueries.RevokeRefreshTokenFamily(req.Context(), family_id)
+	if err != nil {
+		errorResBody.Error = "Error while revoking user's tokens: " + err.Error()
+		jsonResBody, err2 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err2, 500)
+		return
 	}
 
-	jsonResBody, err8 := json.Marshal(successResBody)
-	writeJSONResponse(response_writer, jsonResBody, err8, 200)
+	errorResBody.Error = "This refresh token was already used, log in again"
+	jsonResBody, err3 := json.Marshal(errorResBody)
+	writeJSONResponse(response_writer, jsonResBody, err3, 401)
 }
 
 func (cfg *apiConfig) handleRevokeToken(response_writer http.ResponseWriter, req *http.Request) {
@@ -200,7 +422,7 @@ func (cfg *apiConfig) handleRevokeToken(response_writer http.ResponseWriter, req
 		return
 	}
 
-	err3 := cfg.DBQueries.SetRefreshTokenAsRevoked(req.Context(), tokenString)
+	err3 := cfg.DBQueries.SetRefreshTokenAsRevoked(req.Context(), auth.HashRefreshToken(tokenString, cfg.RefreshTokenKey))
 	if err3 != nil {
 		errorResBody.Error = "Error while revoking user's token: " + err3.Error()
 		jsonResBody, err4 := json.Marshal(errorResBody)
@@ -217,38 +439,100 @@ func (cfg *apiConfig) handleUpdateUser(response_writer http.ResponseWriter, req
 
 	email := req.Context().Value("email").(string)
 	password := req.Context().Value("password").(string)
+	handle := req.Context().Value("handle").(string)
 	user_id := req.Context().Value("user_id").(uuid.UUID)
 
-	hashed, err := auth.HashPassword(password)
+	old_user, err := cfg.DBQueries.GetUserById(req.Context(), user_id)
 	if err != nil {
-		errorResBody.Error = err.Error()
+		errorResBody.Error = "Error while fetching user: " + err.Error()
 		jsonResBody, err2 := json.Marshal(errorResBody)
-		writeJSONResponse(response_writer, jsonResBody, err2, 400)
+		writeJSONResponse(response_writer, jsonResBody, err2, 500)
+		return
+	}
+
+	hashed, err3 := auth.HashPassword(password)
+	if err3 != nil {
+		errorResBody.Error = err3.Error()
+		jsonResBody, err4 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err4, 400)
 		return
 	}
 
 	db_user := database.UpdateUserInfoParams{
 		Email:          email,
 		HashedPassword: hashed,
+		Handle:         sql.NullString{String: handle, Valid: handle != ""},
 		ID:             user_id,
 	}
 	user, err5 := cfg.DBQueries.UpdateUserInfo(req.Context(), db_user)
+	if isUniqueViolation(err5, "uq_users_handle") {
+		errorResBody.Error = "This handle is already taken"
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 409)
+		return
+	}
 	if err5 != nil {
 		errorResBody.Error = "Error while creating user: " + err5.Error()
-		jsonResBody, err6 := json.Marshal(errorResBody)
-		writeJSONResponse(response_writer, jsonResBody, err6, 500)
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 500)
 		return
 	}
 
+	// the new address is unverified until the user opens the link sent to it
+	if user.Email != old_user.Email {
+		if err8 := cfg.sendEmailVerification(req.Context(), user); err8 != nil {
+			log.Printf("Error while sending verification email to user %s: %v", user.ID, err8)
+		}
+	}
+
 	successResBody := userSuccessResponseBody{
+		ID:            user.ID.String(),
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Handle:        user.Handle,
+		Role:          user.Role,
+		IsChirpyRed:   user.IsChirpyRed,
+	}
+	jsonResBody, err9 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err9, 200)
+}
+
+func (cfg *apiConfig) handleGetUserProfile(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+	var jsonResBody []byte
+
+	handle, ok := normalizeHandle(req.PathValue("handle"))
+	if !ok {
+		errorResBody.Error = "Invalid handle"
+		jsonResBody, err := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err, 400)
+		return
+	}
+
+	user, err2 := cfg.DBQueries.GetUserByHandle(req.Context(), handle)
+	if err2 != nil {
+		errorResBody.Error = "No user with this handle"
+		jsonResBody, err3 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err3, 404)
+		return
+	}
+
+	successResBody := userProfile{
 		ID:          user.ID.String(),
 		CreatedAt:   user.CreatedAt,
-		UpdatedAt:   user.UpdatedAt,
-		Email:       user.Email,
+		Handle:      user.Handle,
 		IsChirpyRed: user.IsChirpyRed,
 	}
-	jsonResBody, err13 := json.Marshal(successResBody)
-	writeJSONResponse(response_writer, jsonResBody, err13, 200)
+	jsonResBody, err4 := json.Marshal(successResBody)
+	writeJSONResponse(response_writer, jsonResBody, err4, 200)
+}
+
+// isUniqueViolation reports whether err comes from Postgres rejecting a row because of the given unique constraint.
+func isUniqueViolation(err error, constraint string) bool {
+	var pq_err *pq.Error
+	return errors.As(err, &pq_err) && pq_err.Code == "23505" && pq_err.Constraint == constraint
 }
 
 func (cfg *apiConfig) handleDeleteChirp(response_writer http.ResponseWriter, req *http.Request) {
@@ -266,28 +550,114 @@ func (cfg *apiConfig) handleDeleteChirp(response_writer http.ResponseWriter, req
 		return
 	}
 
-	chirp, err3 := cfg.DBQueries.GetChirpById(req.Context(), chirp_uuid)
+	tx, err3 := cfg.DB.BeginTx(req.Context(), nil)
 	if err3 != nil {
-		errorResBody.Error = "No chirp with this id: " + err3.Error()
+		errorResBody.Error = "Error while starting transaction: " + err3.Error()
 		jsonResBody, err4 := json.Marshal(errorResBody)
-		writeJSONResponse(response_writer, jsonResBody, err4, 404)
+		writeJSONResponse(response_writer, jsonResBody, err4, 500)
+		return
+	}
+	defer tx.Rollback()
+	queries := cfg.DBQueries.WithTx(tx)
+
+	chirp, err5 := queries.GetChirpByIdForUpdate(req.Context(), chirp_uuid)
+	if err5 != nil || chirp.DeletedAt.Valid {
+		errorResBody.Error = "No chirp with this id"
+		jsonResBody, err6 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err6, 404)
 		return
 	}
 
 	if chirp.UserID != user_id {
 		errorResBody.Error = "You don't have access to do anything on this chirp: "
-		jsonResBody, err5 := json.Marshal(errorResBody)
-		writeJSONResponse(response_writer, jsonResBody, err5, 403)
+		jsonResBody, err7 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err7, 403)
 		return
 	}
 
-	err6 := cfg.DBQueries.DeleteChirpById(req.Context(), chirp.ID)
-	if err6 != nil {
-		errorResBody.Error = "Error while deleting chirp: " + err6.Error()
-		jsonResBody, err7 := json.Marshal(errorResBody)
-		writeJSONResponse(response_writer, jsonResBody, err7, 500)
+	// rechirps have nothing of their own to show once the original is gone; quotes stay and show a placeholder
+	deleted_rechirps, err8 := queries.DeleteRechirpsOf(req.Context(), uuid.NullUUID{UUID: chirp.ID, Valid: true})
+	if err8 != nil {
+		errorResBody.Error = "Error while deleting rechirps of chirp: " + err8.Error()
+		jsonResBody, err9 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err9, 500)
+		return
+	}
+
+	replies, err10 := queries.CountChirpReplies(req.Context(), uuid.NullUUID{UUID: chirp.ID, Valid: true})
+	if err10 != nil {
+		errorResBody.Error = "Error while counting chirp replies: " + err10.Error()
+		jsonResBody, err11 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err11, 500)
 		return
 	}
 
+	// a chirp with replies is replaced by a tombstone so that the thread keeps its shape
+	if replies > 0 {
+		_, err12 := queries.TombstoneChirp(req.Context(), chirp.ID)
+		if err12 == nil {
+			err12 = queries.DeleteChirpRevisions(req.Context(), chirp.ID)
+		}
+		if err12 == nil {
+			err12 = queries.DeleteChirpTags(req.Context(), chirp.ID)
+		}
+		if err12 != nil {
+			errorResBody.Error = "Error while deleting chirp: " + err12.Error()
+			jsonResBody, err13 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err13, 500)
+			return
+		}
+	} else {
+		err14 := queries.DeleteChirpById(req.Context(), chirp.ID)
+		if err14 != nil {
+			errorResBody.Error = "Error while deleting chirp: " + err14.Error()
+			jsonResBody, err15 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err15, 500)
+			return
+		}
+	}
+
+	// tombstones above the chirp were only kept for their replies, so they go once the last one is gone.
+	// Each parent is locked first: when two of its replies are deleted at once, the second sees the first is gone
+	removed_tombstones := []database.Chirp{}
+	parent_id := chirp.InReplyTo
+	for replies == 0 && parent_id.Valid {
+		if _, err16 := queries.GetChirpByIdForUpdate(req.Context(), parent_id.UUID); err16 != nil {
+			errorResBody.Error = "Error while locking parent chirp: " + err16.Error()
+			jsonResBody, err17 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err17, 500)
+			return
+		}
+
+		tombstone, err18 := queries.DeleteTombstoneWithoutReplies(req.Context(), parent_id.UUID)
+		if errors.Is(err18, sql.ErrNoRows) {
+			break
+		}
+		if err18 != nil {
+			errorResBody.Error = "Error while deleting tombstone of parent chirp: " + err18.Error()
+			jsonResBody, err19 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err19, 500)
+			return
+		}
+		removed_tombstones = append(removed_tombstones, tombstone)
+		parent_id = tombstone.InReplyTo
+	}
+
+	if err20 := tx.Commit(); err20 != nil {
+		errorResBody.Error = "Error while committing chirp deletion: " + err20.Error()
+		jsonResBody, err21 := json.Marshal(errorResBody)
+		writeJSONResponse(response_writer, jsonResBody, err21, 500)
+		return
+	}
+
+	cfg.publishChirpDeleted(chirp.ID, chirp.UserID, chirp.RootID)
+	for _, tombstone := range removed_tombstones {
+		cfg.publishChirpDeleted(tombstone.ID, tombstone.UserID, tombstone.RootID)
+	}
+	for _, rechirp := range deleted_rechirps {
+		// a rechirp is the root of its own thread
+		cfg.publishChirpDeleted(rechirp.ID, rechirp.UserID, rechirp.ID)
+	}
+
 	response_writer.WriteHeader(204)
 }
@@ -56,7 +56,7 @@ func (cfg *apiConfig) webhookHandler(response_writer http.ResponseWriter, req *h
 				return
 			}
 
-			_, err5 := cfg.DBQueries.UpgradeUserTOChirpyRed(req.Context(), user_uuid)
+			user, err5 := cfg.DBQueries.UpgradeUserTOChirpyRed(req.Context(), user_uuid)
 			if err5 != nil {
 				errorResBody.Error = "Error while upgrading user to chirpy red: " + err5.Error()
 				jsonResBody, err6 := json.Marshal(errorResBody)
@@ -65,6 +65,11 @@ func (cfg *apiConfig) webhookHandler(response_writer http.ResponseWriter, req *h
 				return
 			}
 
+			cfg.Notifier.Notify(pendingNotification{
+				UserID: user.ID,
+				Kind:   NOTIFICATION_CHIRPY_RED,
+			})
+
 			response_writer.WriteHeader(204)
 		}
 	default:
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OmarJarbou/Chirpy/internal/auth"
+	"github.com/OmarJarbou/Chirpy/internal/database"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const WS_AUTH_TIMEOUT = 10 * time.Second
+const WS_PONG_WAIT = 60 * time.Second
+const WS_PING_PERIOD = WS_PONG_WAIT * 9 / 10
+const WS_WRITE_WAIT = 10 * time.Second
+const WS_MAX_MESSAGE_SIZE = 4096
+const WS_SEND_BUFFER_SIZE = 64
+
+// 4000-4999 are close codes left to applications
+const WS_CLOSE_TOKEN_EXPIRED = 4001
+
+const WS_CHANNEL_NOTIFICATIONS = "notifications"
+const WS_CHANNEL_TIMELINE = "timeline"
+const WS_CHANNEL_THREAD_PREFIX = "thread:"
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+type wsClientMessage struct {
+	Type    string `json:"type"`
+	Token   string `json:"token"`
+	Channel string `json:"channel"`
+}
+
+type wsServerMessage struct {
+	Type      string      `json:"type"`
+	Channel   string      `json:"channel,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+}
+
+// wsHub keeps track of the open websocket connections of every user, so notifications saved in the background can reach them.
+type wsHub struct {
+	mu      sync.Mutex
+	clients map[uuid.UUID]map[*wsClient]struct{}
+}
+
+// wsClient is one websocket connection.
+// The read loop runs in the handler's goroutine and everything it sends goes through the buffered send channel,
+// written by a single writer goroutine. A client that lets that buffer fill up is disconnected rather than slowing anybody else down.
+type wsClient struct {
+	cfg  *apiConfig
+	ctx  context.Context
+	conn *websocket.Conn
+	send chan []byte
+
+	close_once sync.Once
+	done       chan struct{}
+
+	mu            sync.Mutex
+	user_id       uuid.UUID
+	authenticated bool
+	expiry_timer  *time.Timer
+	notifications bool
+	timeline      map[uuid.UUID]bool
+	threads       map[uuid.UUID]bool
+	chirp_events  *chirpSubscriber
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{
+		clients: map[uuid.UUID]map[*wsClient]struct{}{},
+	}
+}
+
+func (h *wsHub) add(client *wsClient, user_id uuid.UUID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.clients[user_id] == nil {
+		h.clients[user_id] = map[*wsClient]struct{}{}
+	}
+	h.clients[user_id][client] = struct{}{}
+}
+
+func (h *wsHub) remove(client *wsClient, user_id uuid.UUID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.clients[user_id], client)
+	if len(h.clients[user_id]) == 0 {
+		delete(h.clients, user_id)
+	}
+}
+
+// DeliverNotification pushes a freshly saved notification to every connection of its user that subscribed to notifications.
+func (h *wsHub) DeliverNotification(notification database.Notification) {
+	h.mu.Lock()
+	clients := []*wsClient{}
+	for client := range h.clients[notification.UserID] {
+		clients = append(clients, client)
+	}
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		client.mu.Lock()
+		subscribed := client.notifications
+		client.mu.Unlock()
+
+		if subscribed {
+			client.enqueue(wsServerMessage{
+				Type:    "notification",
+				Channel: WS_CHANNEL_NOTIFICATIONS,
+				Data:    newNotificationResponse(notification, ""),
+			})
+		}
+	}
+}
+
+func (cfg *apiConfig) handleWebSocket(response_writer http.ResponseWriter, req *http.Request) {
+	errorResBody := errorResponseBody{}
+
+	// clients that can set headers authenticate during the handshake, the others with an "auth" message right after it
+	user_id := uuid.UUID{}
+	expires_at := time.Time{}
+	authenticated := false
+	if req.Header.Get("Authorization") != "" {
+		token_string, err := auth.GetBearerToken(req.Header)
+		if err != nil {
+			errorResBody.Error = err.Error()
+			jsonResBody, err2 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err2, 401)
+			return
+		}
+
+		validated_user_id, validated_expires_at, err3 := cfg.JWTKeys.ValidateJWTWithExpiry(token_string)
+		if err3 != nil {
+			errorResBody.Error = err3.Error()
+			jsonResBody, err4 := json.Marshal(errorResBody)
+			writeJSONResponse(response_writer, jsonResBody, err4, 401)
+			return
+		}
+		user_id, expires_at, authenticated = validated_user_id, validated_expires_at, true
+	}
+
+	// Upgrade answers the request itself when the handshake is invalid
+	conn, err5 := wsUpgrader.Upgrade(response_writer, req, nil)
+	if err5 != nil {
+		return
+	}
+
+	client := &wsClient{
+		cfg:  cfg,
+		ctx:  req.Context(),
+		conn: conn,
+		send: make(chan []byte, WS_SEND_BUFFER_SIZE),
+		done: make(chan struct{}),
+	}
+	defer client.close(websocket.CloseNormalClosure, "")
+
+	go client.writeLoop()
+
+	if authenticated {
+		client.authenticate(user_id, expires_at)
+	} else {
+		time.AfterFunc(WS_AUTH_TIMEOUT, func() {
+			client.mu.Lock()
+			authenticated := client.authenticated
+			client.mu.Unlock()
+			if !authenticated {
+				client.close(websocket.ClosePolicyViolation, "authentication timeout")
+			}
+		})
+	}
+
+	client.readLoop()
+}
+
+func (c *wsClient) readLoop() {
+	c.conn.SetReadLimit(WS_MAX_MESSAGE_SIZE)
+	c.conn.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		message := wsClientMessage{}
+		if err2 := json.Unmarshal(data, &message); err2 != nil {
+			c.sendError("Error while decoding message's json " + err2.Error())
+			continue
+		}
+
+		c.handleMessage(message)
+	}
+}
+
+func (c *wsClient) writeLoop() {
+	ping := time.NewTicker(WS_PING_PERIOD)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_WAIT))
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WS_WRITE_WAIT)); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		}
+	}
+}
+
+func (c *wsClient) handleMessage(message wsClientMessage) {
+	if message.Type == "auth" {
+		user_id, expires_at, err := c.cfg.JWTKeys.ValidateJWTWithExpiry(message.Token)
+		if err != nil {
+			c.sendError(err.Error())
+			return
+		}
+
+		c.mu.Lock()
+		switched_user := c.authenticated && c.user_id != user_id
+		c.mu.Unlock()
+		if switched_user {
+			c.sendError("This connection belongs to another user")
+			return
+		}
+
+		c.authenticate(user_id, expires_at)
+		return
+	}
+
+	c.mu.Lock()
+	authenticated := c.authenticated
+	c.mu.Unlock()
+	if !authenticated {
+		c.sendError("Send an auth message first")
+		return
+	}
+
+	switch message.Type {
+	case "subscribe":
+		channel, err := c.subscribe(message.Channel)
+		if err != nil {
+			c.sendError(err.Error())
+			return
+		}
+		c.enqueue(wsServerMessage{Type: "subscribed", Channel: channel})
+	case "unsubscribe":
+		c.unsubscribe(message.Channel)
+		c.enqueue(wsServerMessage{Type: "unsubscribed", Channel: message.Channel})
+	default:
+		c.sendError("Unknown message type: " + message.Type)
+	}
+}
+
+// authenticate starts (or, with a refreshed token, extends) the connection's session.
+// The connection is closed as soon as the token it was opened with expires.
+func (c *wsClient) authenticate(user_id uuid.UUID, expires_at time.Time) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	c.mu.Lock()
+	first_time := !c.authenticated
+	c.user_id = user_id
+	c.authenticated = true
+	if c.expiry_timer != nil {
+		c.expiry_timer.Stop()
+		c.expiry_timer = nil
+	}
+	if !expires_at.IsZero() {
+		c.expiry_timer = time.AfterFunc(time.Until(expires_at), func() {
+			c.close(WS_CLOSE_TOKEN_EXPIRED, "token expired")
+		})
+	}
+	c.mu.Unlock()
+
+	if first_time {
+		c.cfg.WSHub.add(c, user_id)
+		// close may have run in between, after it looked for the client in the hub
+		select {
+		case <-c.done:
+			c.cfg.WSHub.remove(c, user_id)
+			return
+		default:
+		}
+	}
+
+	response := wsServerMessage{Type: "authenticated"}
+	if !expires_at.IsZero() {
+		response.ExpiresAt = &expires_at
+	}
+	c.enqueue(response)
+}
+
+// subscribe returns the channel the events will be sent on, threads are always named after their root chirp.
+func (c *wsClient) subscribe(channel string) (string, error) {
+	switch {
+	case channel == WS_CHANNEL_NOTIFICATIONS:
+		c.mu.Lock()
+		c.notifications = true
+		c.mu.Unlock()
+		return channel, nil
+
+	case channel == WS_CHANNEL_TIMELINE:
+		c.mu.Lock()
+		user_id := c.user_id
+		c.mu.Unlock()
+
+		// the timeline is the user's own chirps and the chirps of everybody they follow when they subscribe
+		followee_ids, err := c.cfg.DBQueries.GetFolloweeIds(c.ctx, user_id)
+		if err != nil {
+			return "", errors.New("Error while fetching followed users from database: " + err.Error())
+		}
+		timeline := map[uuid.UUID]bool{user_id: true}
+		for _, followee_id := range followee_ids {
+			timeline[followee_id] = true
+		}
+
+		c.mu.Lock()
+		c.timeline = timeline
+		c.mu.Unlock()
+		c.listenToChirps()
+		return channel, nil
+
+	case strings.HasPrefix(channel, WS_CHANNEL_THREAD_PREFIX):
+		chirp_id, err := uuid.Parse(strings.TrimPrefix(channel, WS_CHANNEL_THREAD_PREFIX))
+		if err != nil {
+			return "", errors.New("Invalid UUID: " + err.Error())
+		}
+
+		// any chirp of the thread works, the subscription follows its root
+		chirp, err2 := c.cfg.DBQueries.GetChirpById(c.ctx, chirp_id)
+		if err2 != nil {
+			return "", errors.New("No chirp with this id")
+		}
+
+		c.mu.Lock()
+		if c.threads == nil {
+			c.threads = map[uuid.UUID]bool{}
+		}
+		c.threads[chirp.RootID] = true
+		c.mu.Unlock()
+		c.listenToChirps()
+		return WS_CHANNEL_THREAD_PREFIX + chirp.RootID.String(), nil
+	}
+
+	return "", errors.New("Unknown channel: " + channel)
+}
+
+func (c *wsClient) unsubscribe(channel string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case channel == WS_CHANNEL_NOTIFICATIONS:
+		c.notifications = false
+	case channel == WS_CHANNEL_TIMELINE:
+		c.timeline = nil
+	case strings.HasPrefix(channel, WS_CHANNEL_THREAD_PREFIX):
+		if chirp_id, err := uuid.Parse(strings.TrimPrefix(channel, WS_CHANNEL_THREAD_PREFIX)); err == nil {
+			delete(c.threads, chirp_id)
+			if chirp, err2 := c.cfg.DBQueries.GetChirpById(c.ctx, chirp_id); err2 == nil {
+				delete(c.threads, chirp.RootID)
+			}
+		}
+	}
+}
+
+// listenToChirps subscribes the connection to the chirp broadcaster the first time it needs chirps.
+// When the broadcaster drops the subscription because this client fell behind, the connection is closed.
+func (c *wsClient) listenToChirps() {
+	c.mu.Lock()
+	if c.chirp_events != nil {
+		c.mu.Unlock()
+		return
+	}
+	subscriber, _ := c.cfg.ChirpStream.Subscribe(uuid.NullUUID{}, 0)
+	c.chirp_events = subscriber
+	c.mu.Unlock()
+
+	go func() {
+		for event := range subscriber.events {
+			for _, channel := range c.chirpChannels(event) {
+				c.enqueue(wsServerMessage{
+					Type:    event.Type,
+					Channel: channel,
+					Data:    json.RawMessage(event.Data),
+				})
+			}
+		}
+		c.close(websocket.CloseTryAgainLater, "client is too slow")
+	}()
+}
+
+func (c *wsClient) chirpChannels(event chirpEvent) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	channels := []string{}
+	if c.timeline[event.AuthorID] {
+		channels = append(channels, WS_CHANNEL_TIMELINE)
+	}
+	if c.threads[event.RootID] {
+		channels = append(channels, WS_CHANNEL_THREAD_PREFIX+event.RootID.String())
+	}
+	return channels
+}
+
+func (c *wsClient) sendError(message string) {
+	c.enqueue(wsServerMessage{Type: "error", Error: message})
+}
+
+// enqueue hands a message to the writer goroutine without ever blocking the caller.
+func (c *wsClient) enqueue(message wsServerMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-c.done:
+	case c.send <- data:
+	default:
+		c.close(websocket.CloseTryAgainLater, "client is too slow")
+	}
+}
+
+// close tells the client why the connection ends, then releases everything the connection holds. It's safe to call more than once.
+func (c *wsClient) close(code int, reason string) {
+	c.close_once.Do(func() {
+		close(c.done)
+
+		if code != websocket.CloseAbnormalClosure {
+			c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(WS_WRITE_WAIT))
+		}
+		c.conn.Close()
+
+		c.mu.Lock()
+		authenticated := c.authenticated
+		user_id := c.user_id
+		if c.expiry_timer != nil {
+			c.expiry_timer.Stop()
+		}
+		chirp_events := c.chirp_events
+		c.mu.Unlock()
+
+		if authenticated {
+			c.cfg.WSHub.remove(c, user_id)
+		}
+		if chirp_events != nil {
+			c.cfg.ChirpStream.Unsubscribe(chirp_events)
+		}
+	})
+}